@@ -13,7 +13,10 @@ import (
 )
 
 var (
-	flagTypes = false
+	flagTypes      = false
+	flagDuplicates = confl.DuplicateLastWins.String()
+	flagDialect    = "default"
+	flagProfile    = ""
 )
 
 func init() {
@@ -21,6 +24,13 @@ func init() {
 
 	flag.BoolVar(&flagTypes, "types", flagTypes,
 		"When set, the types of every defined key will be shown.")
+	flag.StringVar(&flagDuplicates, "duplicates", flagDuplicates,
+		"What to do with keys set more than once: last, error, merge or array.")
+	flag.StringVar(&flagDialect, "dialect", flagDialect,
+		"The syntax to accept: default, dotted, json, nginx or overlay.")
+	flag.StringVar(&flagProfile, "profile", flagProfile,
+		"When set, the data is shown with the sections of these comma "+
+			"separated profiles merged in.")
 
 	flag.Usage = usage
 	flag.Parse()
@@ -38,23 +48,72 @@ func main() {
 	if flag.NArg() < 1 {
 		flag.Usage()
 	}
+	duplicates, err := confl.ParseDuplicateKeys(flagDuplicates)
+	if err != nil {
+		log.Printf("Error: %s", err)
+		flag.Usage()
+	}
+	dialect, err := confl.ParseDialect(flagDialect)
+	if err != nil {
+		log.Printf("Error: %s", err)
+		flag.Usage()
+	}
+	opts := confl.DecodeOptions{
+		CollectErrors: true,
+		DuplicateKeys: duplicates,
+		Dialect:       dialect,
+	}
+	if flagProfile != "" {
+		opts.Profiles = strings.Split(flagProfile, ",")
+	}
+	failed := false
 	for _, f := range flag.Args() {
 		var tmp interface{}
-		md, err := confl.DecodeFile(f, &tmp)
+		md, err := confl.DecodeFileWithOptions(f, &tmp, opts)
 		if err != nil {
-			log.Fatalf("Error in '%s': %s", f, err)
+			printErrors(f, err)
+			failed = true
+			continue
+		}
+		if flagProfile != "" {
+			if err := confl.NewEncoder(os.Stdout).Encode(tmp); err != nil {
+				log.Printf("Error in '%s': %s", f, err)
+				failed = true
+			}
 		}
 		if flagTypes {
 			printTypes(md)
 		}
 	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// printErrors prints every problem found in a file, one per line, in the
+// file:line:column form understood by editors.
+func printErrors(f string, err error) {
+	errs, ok := err.(confl.ErrorList)
+	if !ok {
+		log.Printf("Error in '%s': %s", f, err)
+		return
+	}
+	for _, pe := range errs {
+		// Problems may be in a file included by f.
+		file := pe.File
+		if file == "" {
+			file = f
+		}
+		log.Printf("%s:%d:%d: %s", file, pe.Line, pe.Column, pe.Msg)
+	}
 }
 
 func printTypes(md confl.MetaData) {
 	tabw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
 	for _, key := range md.Keys() {
-		fmt.Fprintf(tabw, "%s%s\t%s\n",
-			strings.Repeat("    ", len(key)-1), key, md.Type(key...))
+		fmt.Fprintf(tabw, "%s%s\t%s\t%s\n",
+			strings.Repeat("    ", len(key)-1), key, md.Type(key...),
+			md.Profile(key...))
 	}
 	tabw.Flush()
 }
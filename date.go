@@ -0,0 +1,91 @@
+package confl
+
+import (
+	"fmt"
+	"time"
+)
+
+// Date is a calendar date without a time of day or time zone, written in
+// confl as a date alone, e.g. `2024-01-31`.
+//
+// A Date can also be decoded into a time.Time, as midnight UTC.
+type Date struct {
+	Year  int
+	Month time.Month
+	Day   int
+}
+
+// ParseDate parses a date in RFC 3339 form, YYYY-MM-DD.
+func ParseDate(s string) (Date, error) {
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return Date{}, err
+	}
+	return Date{t.Year(), t.Month(), t.Day()}, nil
+}
+
+// Time returns the start of the date in the given location.
+func (d Date) Time(loc *time.Location) time.Time {
+	return time.Date(d.Year, d.Month, d.Day, 0, 0, 0, 0, loc)
+}
+
+func (d Date) String() string {
+	return fmt.Sprintf("%04d-%02d-%02d", d.Year, d.Month, d.Day)
+}
+
+func (d Date) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Date) UnmarshalText(text []byte) error {
+	date, err := ParseDate(string(text))
+	if err != nil {
+		return err
+	}
+	*d = date
+	return nil
+}
+
+// TimeOfDay is a time within a day without a date or time zone, written in
+// confl as a time alone, e.g. `07:30:00` or `07:30:00.250`.
+type TimeOfDay struct {
+	Hour       int
+	Minute     int
+	Second     int
+	Nanosecond int
+}
+
+// ParseTimeOfDay parses a time of day in RFC 3339 form, HH:MM:SS with an
+// optional fraction of a second.
+func ParseTimeOfDay(s string) (TimeOfDay, error) {
+	t, err := time.Parse("15:04:05", s)
+	if err != nil {
+		return TimeOfDay{}, err
+	}
+	return TimeOfDay{t.Hour(), t.Minute(), t.Second(), t.Nanosecond()}, nil
+}
+
+func (t TimeOfDay) String() string {
+	s := fmt.Sprintf("%02d:%02d:%02d", t.Hour, t.Minute, t.Second)
+	if t.Nanosecond == 0 {
+		return s
+	}
+	frac := fmt.Sprintf("%09d", t.Nanosecond)
+	for frac[len(frac)-1] == '0' {
+		frac = frac[:len(frac)-1]
+	}
+	return s + "." + frac
+}
+
+func (t TimeOfDay) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+func (t *TimeOfDay) UnmarshalText(text []byte) error {
+	tod, err := ParseTimeOfDay(string(text))
+	if err != nil {
+		return err
+	}
+	*t = tod
+	return nil
+}
@@ -4,8 +4,10 @@ import (
 	"fmt"
 	u "github.com/araddon/gou"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"math"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"time"
@@ -48,12 +50,69 @@ func (md *MetaData) PrimitiveDecode(primValue Primitive, v interface{}) error {
 	return md.unify(primValue.undecoded, rvalue(v))
 }
 
+// DecodeOptions control how data is parsed and decoded. The zero value
+// behaves just like Decode.
+type DecodeOptions struct {
+	// CollectErrors keeps parsing after a syntax error, so that every
+	// problem in the data is reported at once as an ErrorList.
+	CollectErrors bool
+
+	// Dialect is the syntax to accept, DefaultDialect unless it is set.
+	Dialect Dialect
+
+	// DottedKeys makes unquoted keys with dots, like `db.primary.host`,
+	// name nested hashes, which are merged with any blocks for the same
+	// keys. Quoted keys are always used exactly as written.
+	DottedKeys bool
+
+	// DuplicateKeys is what to do with a key set more than once in the same
+	// hash. By default, the last value wins.
+	DuplicateKeys DuplicateKeys
+
+	// IncludeDir enables include directives, with file names relative to
+	// this directory. DecodeFile always enables them, relative to the
+	// directory of the file being decoded.
+	IncludeDir string
+
+	// IncludeFS enables include directives, reading the included files from
+	// this file system rather than the OS. File names are relative to
+	// IncludeDir within it, or to the root if that is empty.
+	IncludeFS fs.FS
+
+	// Resolvers adds resolvers for references with other schemes than
+	// `env` and `file`, or replaces those, by scheme.
+	Resolvers map[string]Resolver
+
+	// Profiles selects the profiles whose sections, such as
+	// `@production { }`, are merged over the rest of the data. When it is
+	// nil, they are taken from the CONFL_PROFILE environment variable, a
+	// comma separated list.
+	Profiles []string
+
+	// StrictNull makes it an error to decode null into anything other than
+	// a pointer, map, slice or interface, which are set to nil. Otherwise
+	// such values are left as they were.
+	StrictNull bool
+
+	// Safe disables resolvers and include directives, so that untrusted
+	// data cannot read the environment or files.
+	Safe bool
+
+	// the name of the file being decoded, if any
+	file string
+}
+
+// Decoder reads and decodes a document from an io.Reader.
+//
+// Parsing and decoding can be controlled with the Options field.
 type Decoder struct {
+	Options DecodeOptions
+
 	reader io.Reader
 }
 
 func NewDecoder(r io.Reader) *Decoder {
-	return &Decoder{r}
+	return &Decoder{reader: r}
 }
 
 func (dec *Decoder) Decode(v interface{}) error {
@@ -61,7 +120,7 @@ func (dec *Decoder) Decode(v interface{}) error {
 	if err != nil {
 		return err
 	}
-	_, err = Decode(string(bs), v)
+	_, err = DecodeWithOptions(string(bs), v, dec.Options)
 	return err
 }
 
@@ -79,7 +138,15 @@ func Unmarshal(bs []byte, v interface{}) error {
 // confl arrays of tables correspond to either a slice of structs or a slice
 // of maps.
 //
-// confl datetimes correspond to Go `time.Time` values.
+// confl datetimes correspond to Go `time.Time` values, keeping their offset
+// from UTC. Dates and times of day on their own correspond to Date and
+// TimeOfDay values, and dates can also be decoded into `time.Time`.
+//
+// confl nulls, `null` or `nil`, set Go pointers, maps, slices and interfaces
+// to nil, and leave other values as they were.
+//
+// confl durations, e.g. `30s` or `1h30m`, correspond to `time.Duration`
+// values, which can also be decoded from strings holding a duration.
 //
 // All other confl types (float, string, int, bool and array) correspond
 // to the obvious Go types.
@@ -107,25 +174,49 @@ func Unmarshal(bs []byte, v interface{}) error {
 // This decoder will not handle cyclic types. If a cyclic type is passed,
 // `Decode` will not terminate.
 func Decode(data string, v interface{}) (MetaData, error) {
-	p, err := parse(data)
+	return DecodeWithOptions(data, v, DecodeOptions{})
+}
+
+// DecodeWithOptions is just like Decode, except parsing and decoding are
+// controlled by opts.
+func DecodeWithOptions(data string, v interface{}, opts DecodeOptions) (MetaData, error) {
+	p, err := parse(data, opts)
+	if err != nil {
+		return MetaData{}, err
+	}
+	// Operations on keys the data didn't set are applied to nothing.
+	mapping, err := Merge(nil, p.mapping)
 	if err != nil {
 		return MetaData{}, err
 	}
 	md := MetaData{
-		p.mapping, p.types, p.ordered,
+		mapping, p.types, p.ordered,
 		make(map[string]bool, len(p.ordered)), nil,
+		p.positions, p.keyProfiles, opts.StrictNull,
+	}
+	var root interface{} = mapping
+	if p.root != nil {
+		root = p.root
 	}
-	return md, md.unify(p.mapping, rvalue(v))
+	return md, md.unify(root, rvalue(v))
 }
 
 // DecodeFile is just like Decode, except it will automatically read the
-// contents of the file at `fpath` and decode it for you.
+// contents of the file at `fpath` and decode it for you. Files named by
+// include directives are read relative to the directory of `fpath`.
 func DecodeFile(fpath string, v interface{}) (MetaData, error) {
+	return DecodeFileWithOptions(fpath, v, DecodeOptions{})
+}
+
+// DecodeFileWithOptions is just like DecodeFile, except parsing and decoding
+// are controlled by opts.
+func DecodeFileWithOptions(fpath string, v interface{}, opts DecodeOptions) (MetaData, error) {
 	bs, err := ioutil.ReadFile(fpath)
 	if err != nil {
 		return MetaData{}, err
 	}
-	return Decode(string(bs), v)
+	opts.file = filepath.Clean(fpath)
+	return DecodeWithOptions(string(bs), v, opts)
 }
 
 // DecodeReader is just like Decode, except it will consume all bytes
@@ -157,6 +248,10 @@ func (md *MetaData) unify(data interface{}, rv reflect.Value) error {
 		return nil
 	}
 
+	if data == nil {
+		return md.unifyNull(rv)
+	}
+
 	// Special case. Handle time.Time values specifically.
 	// TODO: Remove this code when we decide to drop support for Go 1.1.
 	// This isn't necessary in Go 1.2 because time.Time satisfies the encoding
@@ -164,6 +259,20 @@ func (md *MetaData) unify(data interface{}, rv reflect.Value) error {
 	if rv.Type().AssignableTo(rvalue(time.Time{}).Type()) {
 		return md.unifyDatetime(data, rv)
 	}
+	// Fields are given as pointers when they satisfy TextUnmarshaler, which
+	// time.Time does, but dates can't be decoded as text.
+	if tv, ok := rv.Interface().(*time.Time); ok {
+		if date, ok := data.(Date); ok {
+			*tv = date.Time(time.UTC)
+			return nil
+		}
+	}
+
+	// Special case. time.Duration is an integer, but is decoded from
+	// durations like `1h30m` rather than from integers.
+	if rv.Type() == reflect.TypeOf(time.Duration(0)) {
+		return md.unifyDuration(data, rv)
+	}
 
 	// Special case. Look for a value satisfying the TextUnmarshaler interface.
 	if v, ok := rv.Interface().(TextUnmarshaler); ok {
@@ -221,6 +330,9 @@ func (md *MetaData) unify(data interface{}, rv reflect.Value) error {
 func (md *MetaData) unifyStruct(mapping interface{}, rv reflect.Value) error {
 	tmap, ok := mapping.(map[string]interface{})
 	if !ok {
+		if args := argsFields(rv.Type()); len(args) > 0 {
+			return md.unifyArgs(mapping, rv, args)
+		}
 		return mismatch(rv, "map", mapping)
 	}
 
@@ -229,6 +341,9 @@ func (md *MetaData) unifyStruct(mapping interface{}, rv reflect.Value) error {
 		fields := cachedTypeFields(rv.Type())
 		for i := range fields {
 			ff := &fields[i]
+			if ff.label || ff.args {
+				continue
+			}
 			if ff.name == key {
 				f = ff
 				break
@@ -239,9 +354,10 @@ func (md *MetaData) unifyStruct(mapping interface{}, rv reflect.Value) error {
 		}
 		if f != nil {
 			subv := rv
-			for _, i := range f.index {
+			for _, i := range f.index[:len(f.index)-1] {
 				subv = indirect(subv.Field(i))
 			}
+			subv = indirectUnlessNull(subv.Field(f.index[len(f.index)-1]), datum)
 			if isUnifiable(subv) {
 				md.decoded[md.context.add(key).String()] = true
 				md.context = append(md.context, key)
@@ -299,6 +415,15 @@ func (md *MetaData) unifyArray(data interface{}, rv reflect.Value) error {
 }
 
 func (md *MetaData) unifySlice(data interface{}, rv reflect.Value) error {
+	if tmap, ok := data.(map[string]interface{}); ok {
+		if labels := labelFields(rv.Type().Elem()); len(labels) > 0 {
+			return md.unifyLabeled(tmap, rv, labels)
+		}
+	}
+	if len(argsFields(rv.Type().Elem())) > 0 && !isArgLists(data) {
+		// A directive that isn't repeated is a single element.
+		data = []interface{}{data}
+	}
 	datav := reflect.ValueOf(data)
 	if datav.Kind() != reflect.Slice {
 		return badtype("slice", data)
@@ -314,22 +439,54 @@ func (md *MetaData) unifySliceArray(data, rv reflect.Value) error {
 	sliceLen := data.Len()
 	for i := 0; i < sliceLen; i++ {
 		v := data.Index(i).Interface()
-		sliceval := indirect(rv.Index(i))
+		sliceval := indirectUnlessNull(rv.Index(i), v)
+		context := md.context
+		md.context = context.index(i)
 		if err := md.unify(v, sliceval); err != nil {
 			return err
 		}
+		md.context = context
 	}
 	return nil
 }
 
 func (md *MetaData) unifyDatetime(data interface{}, rv reflect.Value) error {
-	if _, ok := data.(time.Time); ok {
+	switch data := data.(type) {
+	case time.Time:
 		rv.Set(reflect.ValueOf(data))
 		return nil
+	case Date:
+		rv.Set(reflect.ValueOf(data.Time(time.UTC)))
+		return nil
 	}
 	return badtype("time.Time", data)
 }
 
+// unifyDuration decodes a duration, or a string holding one. Integers other
+// than 0 are rejected rather than taken as nanoseconds.
+func (md *MetaData) unifyDuration(data interface{}, rv reflect.Value) error {
+	switch data := data.(type) {
+	case time.Duration:
+		rv.SetInt(int64(data))
+		return nil
+	case string:
+		d, err := time.ParseDuration(data)
+		if err != nil {
+			return e("Invalid duration '%s': %s", data, err)
+		}
+		rv.SetInt(int64(d))
+		return nil
+	case int64:
+		if data == 0 {
+			rv.SetInt(0)
+			return nil
+		}
+		return e("Integer %d has no unit for time.Duration, use a duration "+
+			"such as '%ds' instead.", data, data)
+	}
+	return badtype("duration", data)
+}
+
 func (md *MetaData) unifyString(data interface{}, rv reflect.Value) error {
 	if s, ok := data.(string); ok {
 		rv.SetString(s)
@@ -408,6 +565,22 @@ func (md *MetaData) unifyBool(data interface{}, rv reflect.Value) error {
 	return badtype("boolean", data)
 }
 
+// unifyNull sets pointers, maps, slices and interfaces to nil, and leaves
+// anything else as it was, unless nulls are strict.
+func (md *MetaData) unifyNull(rv reflect.Value) error {
+	switch rv.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface:
+		if rv.CanSet() {
+			rv.Set(reflect.Zero(rv.Type()))
+			return nil
+		}
+	}
+	if md.strictNull {
+		return e("Cannot set '%s' to null.", rv.Type())
+	}
+	return nil
+}
+
 func (md *MetaData) unifyAnything(data interface{}, rv reflect.Value) error {
 	rv.Set(reflect.ValueOf(data))
 	return nil
@@ -468,6 +641,16 @@ func indirect(v reflect.Value) reflect.Value {
 	return indirect(reflect.Indirect(v))
 }
 
+// indirectUnlessNull is like indirect, except that a null is unified with
+// the value itself, so that a pointer can be set to nil rather than to a new
+// value.
+func indirectUnlessNull(v reflect.Value, data interface{}) reflect.Value {
+	if data == nil {
+		return v
+	}
+	return indirect(v)
+}
+
 func isUnifiable(rv reflect.Value) bool {
 	if rv.CanSet() {
 		return true
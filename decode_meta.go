@@ -1,6 +1,9 @@
 package confl
 
-import "strings"
+import (
+	"fmt"
+	"strings"
+)
 
 // MetaData allows access to meta information about data that may not
 // be inferrable via reflection. In particular, whether a key has been defined
@@ -11,6 +14,11 @@ type MetaData struct {
 	keys    []Key
 	decoded map[string]bool
 	context Key // Used only during decoding.
+
+	positions map[string]Position
+	profiles  map[string]string
+
+	strictNull bool // Used only during decoding.
 }
 
 // IsDefined returns true if the key given exists in the data. The key
@@ -45,12 +53,60 @@ func (md *MetaData) IsDefined(key ...string) bool {
 // does not exist. Keys are case sensitive.
 func (md *MetaData) Type(key ...string) string {
 	fullkey := strings.Join(key, ".")
-	if typ, ok := md.types[fullkey]; ok {
+	if typ, ok := md.types[fullkey]; ok && typ != nil {
 		return typ.typeString()
 	}
 	return ""
 }
 
+// Position returns where the key specified, and its value, were defined
+// in the data. For example, to report the location of a rejected value:
+//
+//	pos := md.Position("db", "port")
+//	fmt.Printf("app.conf:%s: bad port\n", pos.Value.Start)
+//
+// Position will return the zero value if given an empty key or a key that
+// does not exist. Keys are case sensitive.
+func (md *MetaData) Position(key ...string) Position {
+	return md.positions[strings.Join(key, ".")]
+}
+
+// Profile returns the profile whose section, such as `@production { }`,
+// supplied the value of the key specified, or the empty string if it was
+// not supplied by a profile. Keys are case sensitive.
+func (md *MetaData) Profile(key ...string) string {
+	return md.profiles[strings.Join(key, ".")]
+}
+
+// Pos is a location in the data. Lines and columns both start at 1, and
+// columns count runes rather than bytes.
+type Pos struct {
+	Line   int
+	Column int
+}
+
+func (p Pos) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
+}
+
+// Span is a range of the data, from Start up to but not including End.
+// The span of a quoted key or string covers the text between the quotes.
+type Span struct {
+	Start Pos
+	End   Pos
+}
+
+// Position is where a key and its value were found in the data. The value
+// of a hash or an array spans from its opening to its closing bracket.
+//
+// File is the file the key was found in, which may have been included by
+// another. It is empty for keys in data that was not read from a file.
+type Position struct {
+	File  string
+	Key   Span
+	Value Span
+}
+
 // Key is the type of any key, including key groups. Use (MetaData).Keys
 // to get values of this type.
 type Key []string
@@ -66,6 +122,18 @@ func (k Key) add(piece string) Key {
 	return newKey
 }
 
+// index returns a copy of the key with the last piece suffixed by an array
+// index, e.g. `servers` becomes `servers[0]`.
+func (k Key) index(i int) Key {
+	if len(k) == 0 {
+		return Key{fmt.Sprintf("[%d]", i)}
+	}
+	newKey := make(Key, len(k))
+	copy(newKey, k)
+	newKey[len(k)-1] = fmt.Sprintf("%s[%d]", k[len(k)-1], i)
+	return newKey
+}
+
 func (k Key) insert(piece string) Key {
 	newKey := make(Key, len(k), len(k)+1)
 	copy(newKey, k)
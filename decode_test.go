@@ -3,7 +3,10 @@ package confl
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
@@ -420,6 +423,129 @@ func TestDecodeSizedInts(t *testing.T) {
 	}
 }
 
+func TestDecodeMetaData(t *testing.T) {
+	var metaData = `
+name = "app"
+ports = [ 80, 443 ]
+db {
+	host = "localhost"
+	timeout = 1.5
+}
+servers [
+	{ host = "a.com", port = 4242 }
+	{ host = "b.com", port = 4243 }
+]
+started = 1987-07-05T05:45:00Z
+`
+	type server struct {
+		Host string
+	}
+	type config struct {
+		Name    string
+		Ports   []int
+		Servers []server
+	}
+
+	var conf config
+	md, err := Decode(metaData, &conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []string{
+		"name", "ports", "db", "db.host", "db.timeout", "servers",
+		"servers[0].host", "servers[0].port",
+		"servers[1].host", "servers[1].port", "started",
+	}
+	got := make([]string, 0, len(md.Keys()))
+	for _, k := range md.Keys() {
+		got = append(got, k.String())
+	}
+	assert.Equal(t, keys, got)
+
+	types := map[string][]string{
+		"String":    {"name"},
+		"Array":     {"ports"},
+		"Hash":      {"db"},
+		"Float":     {"db", "timeout"},
+		"ArrayHash": {"servers"},
+		"Integer":   {"servers[1]", "port"},
+		"Datetime":  {"started"},
+	}
+	for typ, key := range types {
+		assert.Equal(t, typ, md.Type(key...), "type of %v", key)
+	}
+	assert.Equal(t, "", md.Type("missing"))
+
+	undecoded := make([]string, 0)
+	for _, k := range md.Undecoded() {
+		undecoded = append(undecoded, k.String())
+	}
+	assert.Equal(t, []string{"db", "db.host", "db.timeout",
+		"servers[0].port", "servers[1].port", "started"}, undecoded)
+}
+
+func TestDecodePositions(t *testing.T) {
+	var positionData = `
+name = "app"
+db {
+	hosts = [ "a", "b" ]
+}
+servers [
+	{ port = 4242 }
+]
+`
+	var conf map[string]interface{}
+	md, err := Decode(positionData, &conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key      []string
+		expected Position
+	}{
+		{[]string{"name"}, Position{
+			Key: Span{Pos{2, 1}, Pos{2, 5}}, Value: Span{Pos{2, 9}, Pos{2, 12}}}},
+		{[]string{"db"}, Position{
+			Key: Span{Pos{3, 1}, Pos{3, 3}}, Value: Span{Pos{3, 4}, Pos{5, 2}}}},
+		{[]string{"db", "hosts"}, Position{
+			Key: Span{Pos{4, 2}, Pos{4, 7}}, Value: Span{Pos{4, 10}, Pos{4, 22}}}},
+		{[]string{"servers[0]", "port"}, Position{
+			Key: Span{Pos{7, 4}, Pos{7, 8}}, Value: Span{Pos{7, 11}, Pos{7, 15}}}},
+		{[]string{"missing"}, Position{}},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, md.Position(test.key...),
+			"position of %v", test.key)
+	}
+	assert.Equal(t, "4:10", md.Position("db", "hosts").Value.Start.String())
+}
+
+func TestDecodeCollectErrors(t *testing.T) {
+	var conf struct{ A, B int }
+	data := "a = 1\nb = 2.x\nc = 'd\n"
+
+	_, err := DecodeWithOptions(data, &conf, DecodeOptions{CollectErrors: true})
+	errs, ok := err.(ErrorList)
+	if !ok || len(errs) != 2 {
+		t.Fatalf("Expected 2 errors, but got %v", err)
+	}
+	assert.Equal(t, 0, conf.A, "nothing is decoded when there are errors")
+
+	// The first error is all that is returned by default.
+	_, err = Decode(data, &conf)
+	if _, ok := err.(*ParseError); !ok {
+		t.Fatalf("Expected a *ParseError, but got %T: %v", err, err)
+	}
+
+	dec := NewDecoder(strings.NewReader(data))
+	dec.Options.CollectErrors = true
+	if errs, ok := dec.Decode(&conf).(ErrorList); !ok || len(errs) != 2 {
+		t.Fatalf("Expected 2 errors, but got %v", errs)
+	}
+}
+
 func ExampleMetaData_PrimitiveDecode() {
 	var md MetaData
 	var err error
@@ -605,23 +731,522 @@ song [
 // config document that weren't decoded into the value given. This is useful
 // for returning an error to the user if they've included extraneous fields
 // in their configuration.
-// func Example_strictDecoding() {
-// 	var rawData = `
-// key1 = "value1"
-// key2 = "value2"
-// key3 = "value3"
-// `
-// 	type config struct {
-// 		Key1 string
-// 		Key3 string
-// 	}
-
-// 	var conf config
-// 	md, err := Decode(rawData, &conf)
-// 	if err != nil {
-// 		log.Fatal(err)
-// 	}
-// 	fmt.Printf("Undecoded keys: %q\n", md.Undecoded())
-// 	// Output:
-// 	// Undecoded keys: ["key2"]
-// }
+func Example_strictDecoding() {
+	var rawData = `
+key1 = "value1"
+key2 = "value2"
+key3 = "value3"
+`
+	type config struct {
+		Key1 string
+		Key3 string
+	}
+
+	var conf config
+	md, err := Decode(rawData, &conf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Undecoded keys: %q\n", md.Undecoded())
+	// Output:
+	// Undecoded keys: ["key2"]
+}
+
+func TestDecodeVariables(t *testing.T) {
+	var conf struct {
+		Defaults struct{ Port int }
+		Server   struct {
+			Port int
+			URL  string
+		}
+	}
+	md, err := Decode(`
+server {
+  port = $defaults.port
+  url = "http://localhost:${defaults.port}"
+}
+defaults { port = 8080 }
+`, &conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 8080, conf.Server.Port)
+	assert.Equal(t, "http://localhost:8080", conf.Server.URL)
+	assert.Equal(t, "Integer", md.Type("server", "port"))
+	assert.Equal(t, "String", md.Type("server", "url"))
+}
+
+func TestDecodeResolvers(t *testing.T) {
+	os.Setenv("CONFL_TEST_USER", "bob")
+	os.Unsetenv("CONFL_TEST_UNSET")
+	defer os.Unsetenv("CONFL_TEST_USER")
+
+	dir, err := ioutil.TempDir("", "confl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	token := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(token, []byte("  s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	data := `
+user = ${env:CONFL_TEST_USER}
+host = ${env:CONFL_TEST_UNSET:-localhost}
+token = "${file:` + token + `}"
+url = "vault://${vault:db/password}@${host}"
+`
+	opts := DecodeOptions{Resolvers: map[string]Resolver{
+		"vault": ResolverFunc(func(arg string) (string, error) {
+			return "<" + arg + ">", nil
+		}),
+	}}
+	var conf map[string]interface{}
+	md, err := DecodeWithOptions(data, &conf, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "bob", conf["user"])
+	assert.Equal(t, "localhost", conf["host"])
+	assert.Equal(t, "s3cret", conf["token"])
+	assert.Equal(t, "vault://<db/password>@localhost", conf["url"])
+	assert.Equal(t, "String", md.Type("host"))
+
+	tests := []struct {
+		data string
+		opts DecodeOptions
+		msg  string
+	}{
+		{"a = ${env:CONFL_TEST_UNSET}", DecodeOptions{},
+			"Cannot resolve 'env:CONFL_TEST_UNSET': environment variable 'CONFL_TEST_UNSET' is not set"},
+		{"a = ${nope:x}", DecodeOptions{}, "Unknown resolver 'nope' in 'nope:x'."},
+		{"a = \"${env:CONFL_TEST_USER}\"", DecodeOptions{Safe: true},
+			"Cannot resolve 'env:CONFL_TEST_USER', resolvers are disabled."},
+		{"include \"x.conf\"", DecodeOptions{Safe: true, IncludeDir: dir},
+			"Cannot include 'x.conf', includes are not enabled."},
+	}
+	for _, test := range tests {
+		_, err := DecodeWithOptions(test.data, &conf, test.opts)
+		pe, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("Expected a ParseError for %q, but got %T: %v", test.data, err, err)
+			continue
+		}
+		assert.Equal(t, test.msg, pe.Msg)
+	}
+}
+
+func TestDecodeDatetimes(t *testing.T) {
+	var conf struct {
+		Offset  time.Time
+		Release time.Time
+		Date    Date
+		Alarm   TimeOfDay
+		Dates   []Date
+	}
+	md, err := Decode(`
+offset = 2024-01-31T07:30:00.5-05:00
+release = 2024-01-31
+date = 2024-01-31
+alarm = 07:30:00
+dates = [2024-01-31, "2024-02-01"]
+`, &conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, offset := conf.Offset.Zone()
+	assert.Equal(t, -5*60*60, offset)
+	assert.Equal(t, 500000000, conf.Offset.Nanosecond())
+	assert.Equal(t, time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC), conf.Release)
+	assert.Equal(t, Date{2024, time.January, 31}, conf.Date)
+	assert.Equal(t, TimeOfDay{Hour: 7, Minute: 30}, conf.Alarm)
+	assert.Equal(t, []Date{{2024, time.January, 31}, {2024, time.February, 1}}, conf.Dates)
+	assert.Equal(t, "Date", md.Type("date"))
+	assert.Equal(t, "TimeOfDay", md.Type("alarm"))
+}
+
+func TestDecodeDurations(t *testing.T) {
+	var conf struct {
+		Timeout time.Duration
+		TTL     time.Duration
+		Retry   *time.Duration
+		Zero    time.Duration
+		Backoff []time.Duration
+	}
+	md, err := Decode(`
+timeout = 30s
+ttl = "1h30m"
+retry = 250ms
+zero = 0
+backoff = [1s, "2s"]
+`, &conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 30*time.Second, conf.Timeout)
+	assert.Equal(t, 90*time.Minute, conf.TTL)
+	assert.Equal(t, 250*time.Millisecond, *conf.Retry)
+	assert.Equal(t, time.Duration(0), conf.Zero)
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second}, conf.Backoff)
+	assert.Equal(t, "Duration", md.Type("timeout"))
+
+	// Integers would silently be nanoseconds.
+	_, err = Decode("timeout = 30", &conf)
+	assert.Error(t, err)
+	_, err = Decode(`timeout = "soon"`, &conf)
+	assert.Error(t, err)
+}
+
+func TestDecodeNumbers(t *testing.T) {
+	var conf struct {
+		Perm  os.FileMode
+		Mask  uint8
+		Big   int
+		Ratio float32
+	}
+	_, err := Decode("perm = 0o755\nmask = 0b1111_0000\nbig = 1_000_000\nratio = 2.5e-1", &conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, os.FileMode(0755), conf.Perm)
+	assert.Equal(t, uint8(0xf0), conf.Mask)
+	assert.Equal(t, 1000000, conf.Big)
+	assert.Equal(t, float32(0.25), conf.Ratio)
+}
+
+func TestDecodeByteSize(t *testing.T) {
+	var conf struct {
+		MaxPayload ByteSize `confl:"max_payload"`
+		Buffer     ByteSize
+		Limit      ByteSize
+		Plain      int64
+	}
+	_, err := Decode("max_payload = 64MB\nbuffer = \"2GiB\"\nlimit = 1500\nplain = 1k", &conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 64*MB, conf.MaxPayload)
+	assert.Equal(t, 2*GB, conf.Buffer)
+	assert.Equal(t, ByteSize(1500), conf.Limit)
+	assert.Equal(t, int64(1000), conf.Plain)
+
+	_, err = Decode(`buffer = "lots"`, &conf)
+	assert.Error(t, err)
+
+	// A lone lowercase m is minutes, as it is for the lexer.
+	var b ByteSize
+	assert.Error(t, b.UnmarshalText([]byte("5m")))
+	assert.NoError(t, b.UnmarshalText([]byte("5M")))
+	assert.Equal(t, ByteSize(5e6), b)
+}
+
+func TestDecodeNull(t *testing.T) {
+	n := 5
+	conf := struct {
+		Ptr   *int
+		Map   map[string]int
+		Slice []string
+		Any   interface{}
+		Int   int
+		Ptrs  []*int
+		Hash  map[string]interface{}
+	}{&n, map[string]int{"a": 1}, []string{"a"}, "a", 5, nil, nil}
+	md, err := Decode(`
+ptr = null
+map = null
+slice = nil
+any = null
+int = null
+ptrs = [null]
+hash { a = null }
+`, &conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, (*int)(nil), conf.Ptr)
+	assert.Equal(t, map[string]int(nil), conf.Map)
+	assert.Equal(t, []string(nil), conf.Slice)
+	assert.Equal(t, nil, conf.Any)
+	assert.Equal(t, 5, conf.Int)
+	assert.Equal(t, []*int{nil}, conf.Ptrs)
+	assert.Equal(t, map[string]interface{}{"a": nil}, conf.Hash)
+	assert.Equal(t, "Null", md.Type("ptr"))
+	assert.Equal(t, 5, n)
+
+	_, err = DecodeWithOptions("int = null", &conf, DecodeOptions{StrictNull: true})
+	assert.Error(t, err)
+	_, err = DecodeWithOptions("ptr = null", &conf, DecodeOptions{StrictNull: true})
+	assert.Equal(t, nil, err)
+}
+
+func TestDecodeDottedKeys(t *testing.T) {
+	var conf struct {
+		DB struct {
+			Primary struct {
+				Host string
+				Port int
+			}
+		}
+	}
+	md, err := DecodeWithOptions("db.primary.host = localhost\ndb.primary { port = 5432 }",
+		&conf, DecodeOptions{DottedKeys: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "localhost", conf.DB.Primary.Host)
+	assert.Equal(t, 5432, conf.DB.Primary.Port)
+	assert.Equal(t, "Hash", md.Type("db", "primary"))
+	assert.Equal(t, Pos{1, 1}, md.Position("db", "primary", "host").Key.Start)
+	assert.Equal(t, 0, len(md.Undecoded()))
+}
+
+func TestDecodeImplicitArray(t *testing.T) {
+	type server struct {
+		Listen int
+		Name   string
+	}
+	var conf struct {
+		Server []server
+	}
+	md, err := DecodeWithOptions("server { listen = 80 }\nserver { listen = 443, name = tls }",
+		&conf, DecodeOptions{DuplicateKeys: DuplicateImplicitArray})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []server{{80, ""}, {443, "tls"}}, conf.Server)
+	assert.Equal(t, "ArrayHash", md.Type("server"))
+}
+
+func TestDecodeRoot(t *testing.T) {
+	var conf struct {
+		Name string
+		Port int
+	}
+	md, err := Decode("{\n  \"name\": \"app\", // the app\n  \"port\": 8080\n}", &conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "app", conf.Name)
+	assert.Equal(t, 8080, conf.Port)
+	assert.Equal(t, Pos{3, 4}, md.Position("port").Key.Start)
+
+	type server struct {
+		Host string
+		Port int
+	}
+	var servers []server
+	_, err = Decode(`[
+  {"host": "a", "port": 80},
+  /* the backup */
+  {"host": "b", "port": 81}
+]`, &servers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []server{{"a", 80}, {"b", 81}}, servers)
+
+	var v interface{}
+	_, err = Decode(`["x", 1]`, &v)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []interface{}{"x", int64(1)}, v)
+}
+
+func TestDecodeDialect(t *testing.T) {
+	var conf struct {
+		DB struct {
+			Host string
+			Port int
+		}
+	}
+	dec := NewDecoder(strings.NewReader("db.host = localhost\ndb { port = 5432 }"))
+	dec.Options.Dialect = DottedDialect()
+	if err := dec.Decode(&conf); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "localhost", conf.DB.Host)
+	assert.Equal(t, 5432, conf.DB.Port)
+
+	dec = NewDecoder(strings.NewReader(`{"db": {"host": localhost}}`))
+	dec.Options.Dialect = JSONDialect()
+	assert.NotEqual(t, nil, dec.Decode(&conf))
+
+	d, err := ParseDialect("json")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, JSONDialect(), d)
+	_, err = ParseDialect("yaml")
+	assert.NotEqual(t, nil, err)
+
+	// Presets are copies, and the global IdentityChars is only read when
+	// asked for.
+	d = DefaultDialect()
+	d.Separators = SeparatorColon
+	d, _ = ParseDialect("default")
+	assert.Equal(t, DefaultDialect(), d)
+	defer func(chars string) { IdentityChars = chars }(IdentityChars)
+	IdentityChars = "_.@"
+	assert.Equal(t, "_.", DecodeOptions{}.dialect().IdentifierChars)
+	assert.Equal(t, "_.@", LegacyDialect().IdentifierChars)
+}
+
+func TestDecodeTables(t *testing.T) {
+	type server struct {
+		Name string
+		Port int
+	}
+	var conf struct {
+		DB struct {
+			Host string
+		}
+		Servers []server
+	}
+	md, err := Decode("[db]\nhost = localhost\n\n[[servers]]\nname = a\nport = 80\n\n[[servers]]\nname = b\nport = 81", &conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "localhost", conf.DB.Host)
+	assert.Equal(t, []server{{"a", 80}, {"b", 81}}, conf.Servers)
+	assert.Equal(t, "ArrayHash", md.Type("servers"))
+	assert.Equal(t, Pos{1, 2}, md.Position("db").Key.Start)
+	assert.Equal(t, 0, len(md.Undecoded()))
+}
+
+func TestDecodeLabels(t *testing.T) {
+	type backend struct {
+		Type   string `confl:",label"`
+		Name   string `confl:",label"`
+		Bucket string
+	}
+	type listener struct {
+		Name string `confl:",label"`
+		Port int
+	}
+	var conf struct {
+		Backend  []backend
+		Listener []*listener
+	}
+	md, err := Decode(`
+backend "s3" "primary" { bucket = a }
+backend "gcs" "main" { bucket = c }
+backend "s3" "backup" { bucket = b }
+listener "http" { port = 80 }
+listener "https" { port = 443 }
+`, &conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []backend{
+		{"s3", "primary", "a"},
+		{"gcs", "main", "c"},
+		{"s3", "backup", "b"},
+	}, conf.Backend)
+	assert.Equal(t, []*listener{{"http", 80}, {"https", 443}}, conf.Listener)
+	assert.Equal(t, 0, len(md.Undecoded()))
+
+	var bad struct {
+		Backend []backend
+	}
+	_, err = Decode(`backend "s3" { bucket = a }`, &bad)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestDecodeDirectives(t *testing.T) {
+	type listen struct {
+		Port  int      `confl:",args"`
+		Flags []string `confl:",args"`
+	}
+	var conf struct {
+		Listen []listen
+		Root   struct {
+			Dir string `confl:",args"`
+		}
+		Gzip   bool
+		Server *listen
+	}
+	md, err := DecodeWithOptions(`
+listen 80
+listen 443 ssl http2
+root /var/www
+gzip
+server 8080 backup
+`, &conf, DecodeOptions{Dialect: NginxDialect()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []listen{{80, nil}, {443, []string{"ssl", "http2"}}}, conf.Listen)
+	assert.Equal(t, "/var/www", conf.Root.Dir)
+	assert.Equal(t, true, conf.Gzip)
+	assert.Equal(t, &listen{8080, []string{"backup"}}, conf.Server)
+	assert.Equal(t, 0, len(md.Undecoded()))
+
+	var one struct {
+		Root struct {
+			Dir string `confl:",args"`
+		}
+	}
+	_, err = DecodeWithOptions("root /a /b", &one, DecodeOptions{Dialect: NginxDialect()})
+	assert.NotEqual(t, nil, err)
+}
+
+func TestDecodeOperators(t *testing.T) {
+	var conf struct {
+		Plugins []string
+		Hosts   []string
+		Legacy  *bool `confl:"legacy_mode"`
+	}
+	_, err := DecodeWithOptions(`
+legacy_mode = true
+plugins += [audit]
+hosts = [b]
+hosts ^= a
+-legacy_mode
+`, &conf, DecodeOptions{Dialect: OverlayDialect()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"audit"}, conf.Plugins)
+	assert.Equal(t, []string{"a", "b"}, conf.Hosts)
+	assert.Equal(t, (*bool)(nil), conf.Legacy)
+}
+
+func TestDecodeProfiles(t *testing.T) {
+	type db struct {
+		Host string
+		Pool int
+	}
+	data := `
+db {
+  host = localhost
+  pool = 4
+}
+
+@env(production) {
+  db {
+    host = prod-db
+  }
+}
+`
+	var conf struct{ DB db }
+	md, err := DecodeWithOptions(data, &conf, DecodeOptions{Profiles: []string{"production"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, db{"prod-db", 4}, conf.DB)
+	assert.Equal(t, "production", md.Profile("db", "host"))
+	assert.Equal(t, "", md.Profile("db", "pool"))
+	assert.Equal(t, "String", md.Type("db", "host"))
+	assert.Equal(t, 9, md.Position("db", "host").Key.Start.Line)
+	assert.Equal(t, 0, len(md.Undecoded()))
+	assert.Equal(t, []Key{{"db"}, {"db", "host"}, {"db", "pool"}}, md.Keys())
+
+	// Without the option, the profiles come from CONFL_PROFILE.
+	defer os.Setenv("CONFL_PROFILE", os.Getenv("CONFL_PROFILE"))
+	for profiles, host := range map[string]string{"": "localhost", "staging, production": "prod-db"} {
+		os.Setenv("CONFL_PROFILE", profiles)
+		conf.DB = db{}
+		if _, err := Decode(data, &conf); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, host, conf.DB.Host)
+	}
+}
@@ -0,0 +1,179 @@
+package confl
+
+import "fmt"
+
+// Dialect is the syntax accepted when parsing. Rather than build one from
+// scratch, start from one of DefaultDialect, DottedDialect, JSONDialect,
+// NginxDialect or OverlayDialect and change what needs changing, e.g. to allow only '#' comments:
+//
+//	d := confl.DefaultDialect()
+//	d.Comments = confl.HashComments
+//
+// The zero Dialect is taken to mean DefaultDialect.
+type Dialect struct {
+	// IdentifierChars are the characters other than letters and digits
+	// allowed at the start of unquoted top-level keys and in the names of
+	// variables.
+	IdentifierChars string
+
+	// Separators are the ways a key may be separated from its value.
+	Separators Separators
+
+	// UnquotedKeys allows keys that aren't in quotes.
+	UnquotedKeys bool
+
+	// UnquotedStrings allows strings other than double-quoted ones: unquoted
+	// and single-quoted strings, heredocs, blocks in parens and variables.
+	// The keywords true, false and null are always allowed.
+	UnquotedStrings bool
+
+	// Comments are the styles of comment allowed.
+	Comments Comments
+
+	// TopLevelKeys allows keys to be set at the top level, rather than only
+	// within a single object or array that is the whole document.
+	TopLevelKeys bool
+
+	// DottedKeys makes unquoted keys with dots name nested hashes, just
+	// like DecodeOptions.DottedKeys.
+	DottedKeys bool
+
+	// Directives allows keys followed by whitespace to take any number of
+	// arguments, as nginx directives do: `listen 80 default_server;` sets
+	// listen to the array of its arguments, a key with just one argument is
+	// set to it, and a key on its own is set to true. A directive repeated
+	// in the same hash is set to an array of the arguments of each.
+	Directives bool
+
+	// Operators allows keys to be changed rather than set, as overlays on
+	// another config do: `key += value` appends to an array, `key ^= value`
+	// prepends to one, and `-key` or `unset key` deletes the key. It is off
+	// unless asked for, as `unset key` otherwise sets the key unset.
+	Operators bool
+}
+
+// Separators are the ways a key may be separated from its value, which can
+// be combined, e.g. SeparatorEqual|SeparatorColon.
+type Separators int
+
+const (
+	// SeparatorEqual allows `key = value`.
+	SeparatorEqual Separators = 1 << iota
+
+	// SeparatorColon allows `key: value`.
+	SeparatorColon
+
+	// SeparatorSpace allows `key value` and `key { }`, with nothing but
+	// whitespace between the key and its value, as well as labeled blocks
+	// such as `key "label" { }`.
+	SeparatorSpace
+)
+
+// Comments are styles of comment, which can be combined, e.g.
+// HashComments|BlockComments.
+type Comments int
+
+const (
+	// HashComments allows comments from '#' to the end of the line.
+	HashComments Comments = 1 << iota
+
+	// SlashComments allows comments from '//' to the end of the line.
+	SlashComments
+
+	// BlockComments allows comments between '/*' and '*/'.
+	BlockComments
+)
+
+// DefaultDialect returns the lenient syntax used unless another Dialect is
+// given, which accepts everything confl has to offer.
+func DefaultDialect() Dialect {
+	return Dialect{
+		IdentifierChars: "_.",
+		Separators:      SeparatorEqual | SeparatorColon | SeparatorSpace,
+		UnquotedKeys:    true,
+		UnquotedStrings: true,
+		Comments:        HashComments | SlashComments | BlockComments,
+		TopLevelKeys:    true,
+	}
+}
+
+// DottedDialect returns DefaultDialect with dotted keys, so that
+// `db.primary.host = x` sets the key host in the hash primary within the
+// hash db.
+func DottedDialect() Dialect {
+	d := DefaultDialect()
+	d.DottedKeys = true
+	return d
+}
+
+// JSONDialect returns strict JSON: a single object or array, with quoted
+// keys and strings, colons between keys and values, and no comments.
+// Values such as durations and dates are still read as they are elsewhere.
+func JSONDialect() Dialect {
+	return Dialect{
+		Separators: SeparatorColon,
+	}
+}
+
+// NginxDialect returns DefaultDialect with directives, so that
+// `listen 80 default_server;` sets listen to `[80, "default_server"]`.
+func NginxDialect() Dialect {
+	d := DefaultDialect()
+	d.Directives = true
+	return d
+}
+
+// OverlayDialect returns DefaultDialect with operators, for configs laid
+// over another with Merge, so that `plugins += [audit]` appends to plugins
+// and `-legacy_mode` deletes legacy_mode.
+func OverlayDialect() Dialect {
+	d := DefaultDialect()
+	d.Operators = true
+	return d
+}
+
+// LegacyDialect returns DefaultDialect with the identifier characters of
+// the global IdentityChars.
+//
+// Deprecated: Set the IdentifierChars of a Dialect instead. IdentityChars
+// is shared by every user of the package, and is read nowhere else.
+func LegacyDialect() Dialect {
+	d := DefaultDialect()
+	d.IdentifierChars = IdentityChars
+	return d
+}
+
+var dialectNames = map[string]func() Dialect{
+	"default": DefaultDialect,
+	"dotted":  DottedDialect,
+	"json":    JSONDialect,
+	"nginx":   NginxDialect,
+	"overlay": OverlayDialect,
+}
+
+// ParseDialect returns the dialect with the given name, one of "default",
+// "dotted", "json", "nginx" or "overlay".
+func ParseDialect(name string) (Dialect, error) {
+	if d, ok := dialectNames[name]; ok {
+		return d(), nil
+	}
+	return Dialect{}, fmt.Errorf("unknown dialect '%s'", name)
+}
+
+// dialect returns the dialect to parse with.
+func (opts DecodeOptions) dialect() Dialect {
+	if opts.Dialect != (Dialect{}) {
+		return opts.Dialect
+	}
+	return DefaultDialect()
+}
+
+func (d Dialect) allowsSeparator(r rune) bool {
+	switch r {
+	case keySepEqual:
+		return d.Separators&SeparatorEqual != 0
+	case keySepColon:
+		return d.Separators&SeparatorColon != 0
+	}
+	return d.Separators&SeparatorSpace != 0
+}
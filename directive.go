@@ -0,0 +1,107 @@
+package confl
+
+import "reflect"
+
+// endDirective sets the key of a directive to its arguments, once they have
+// all been parsed. When the same directive is repeated in a hash, the key is
+// instead set to the arguments of each, as an array of arrays, however
+// DecodeOptions.DuplicateKeys is set.
+func (p *parser) endDirective(it item) *ParseError {
+	args, ok := p.popContext().([]interface{})
+	if !ok {
+		p.bug("Unexpected end of directive in array.")
+	}
+	p.endKey(it)
+	key := p.nextKey()
+	lists, repeated := p.directives[key.String()]
+	p.directives[key.String()] = append(lists, args)
+	if !repeated {
+		val := directiveValue(args)
+		if r, ok := val.(*reference); ok {
+			// The reference is the whole value of the key, rather than
+			// one of its arguments.
+			r.key, r.hash = key, true
+		}
+		p.setTypes(key, val)
+		return p.setValue(val)
+	}
+
+	if r, ok := directiveValue(lists[0]).(*reference); ok {
+		r.hash = false
+	}
+	all := make([]interface{}, 0, len(lists)+1)
+	for _, l := range p.directives[key.String()] {
+		all = append(all, l)
+	}
+	p.setTypes(key, all)
+	ctx := p.ctx.(map[string]interface{})
+	ctx[p.popKey()] = all
+	p.currentKey = ""
+	p.leaveDottedKey()
+	return nil
+}
+
+// directiveValue returns the value of a directive with the given arguments:
+// true when there are none, the argument when there is only one, and
+// otherwise all of them.
+func directiveValue(args []interface{}) interface{} {
+	switch len(args) {
+	case 0:
+		return true
+	case 1:
+		return args[0]
+	}
+	return args
+}
+
+// unifyArgs decodes the arguments of a directive into the fields of a
+// struct tagged `confl:",args"`, in order, with a slice as the last of them
+// taking the rest of the arguments. A directive without arguments, which is
+// true, sets none of them.
+func (md *MetaData) unifyArgs(data interface{}, rv reflect.Value, fields []field) error {
+	args, ok := data.([]interface{})
+	if !ok && data != true {
+		args = []interface{}{data}
+	}
+	rest := fields[len(fields)-1].typ.Kind() == reflect.Slice
+	if len(args) > len(fields) && !rest {
+		return e("Expected at most %d arguments for '%s', but got %d.",
+			len(fields), md.context, len(args))
+	}
+	context := md.context
+	defer func() { md.context = context }()
+	for i, f := range fields {
+		if i >= len(args) {
+			break
+		}
+		datum := args[i]
+		if rest && i == len(fields)-1 {
+			datum = args[i:]
+		}
+		subv := rv
+		for _, k := range f.index[:len(f.index)-1] {
+			subv = indirect(subv.Field(k))
+		}
+		subv = indirectUnlessNull(subv.Field(f.index[len(f.index)-1]), datum)
+		md.context = context.index(i)
+		if err := md.unify(datum, subv); err != nil {
+			return e("Type mismatch for '%s.%s': %s", rv.Type().String(), f.name, err)
+		}
+	}
+	return nil
+}
+
+// isArgLists returns true if data is the arguments of a repeated directive,
+// an array of arrays.
+func isArgLists(data interface{}) bool {
+	lists, ok := data.([]interface{})
+	if !ok || len(lists) == 0 {
+		return false
+	}
+	for _, l := range lists {
+		if _, ok := l.([]interface{}); !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,125 @@
+package confl
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// DuplicateKeys is what to do with a key that is set more than once in the
+// same hash.
+type DuplicateKeys int
+
+const (
+	// DuplicateLastWins replaces the earlier value with the later one.
+	DuplicateLastWins DuplicateKeys = iota
+
+	// DuplicateError makes a key set more than once an error, which gives
+	// where it was first set.
+	DuplicateError
+
+	// DuplicateDeepMerge merges a hash into the hash set earlier for the
+	// same key, key by key and into any hashes within them. Other values
+	// replace the earlier one.
+	DuplicateDeepMerge
+
+	// DuplicateImplicitArray collects every value set for the key into an
+	// array, as libucl does, so that repeated blocks like
+	// `server { } server { }` become an array of hashes.
+	DuplicateImplicitArray
+)
+
+var duplicateKeysNames = []string{"last", "error", "merge", "array"}
+
+func (d DuplicateKeys) String() string {
+	if int(d) < len(duplicateKeysNames) {
+		return duplicateKeysNames[d]
+	}
+	return fmt.Sprintf("DuplicateKeys(%d)", int(d))
+}
+
+// ParseDuplicateKeys returns the policy with the given name, one of "last",
+// "error", "merge" or "array".
+func ParseDuplicateKeys(name string) (DuplicateKeys, error) {
+	for i, n := range duplicateKeysNames {
+		if n == name {
+			return DuplicateKeys(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown duplicate keys policy '%s'", name)
+}
+
+// hashKey is a key within a particular hash.
+type hashKey struct {
+	hash uintptr
+	key  string
+}
+
+// duplicateValue returns the value to set for a key in ctx that already has
+// the value old, according to the duplicate keys policy.
+func (p *parser) duplicateValue(ctx map[string]interface{}, old, val interface{}) (interface{}, *ParseError) {
+	if isSameHash(old, val) {
+		// A block was merged into the hash made for dotted keys.
+		return val, nil
+	}
+	switch p.duplicates {
+	case DuplicateError:
+		key := p.nextKey()
+		span := p.keySpans[len(p.keySpans)-1]
+		return nil, p.errorf(span.Start, "Key '%s' is already defined %s.",
+			key, p.where(p.previous[key.String()]))
+	case DuplicateDeepMerge:
+		oldHash, ok := old.(map[string]interface{})
+		newHash, isNewHash := val.(map[string]interface{})
+		if ok && isNewHash {
+			mergeHashes(oldHash, newHash)
+			return oldHash, nil
+		}
+	case DuplicateImplicitArray:
+		key := hashKey{reflect.ValueOf(ctx).Pointer(), p.topKey()}
+		array, ok := old.([]interface{})
+		if ok && p.repeated[key] {
+			array = append(array, val)
+		} else {
+			array = []interface{}{old, val}
+			p.repeated[key] = true
+		}
+		p.setType(p.topKey(), typeOfArrayValues(array))
+		return array, nil
+	}
+	return val, nil
+}
+
+// forgetRepeated forgets that a key in ctx was repeated, once it has been
+// deleted or changed by an operation, so that its value is no longer taken
+// to be an implicit array.
+func (p *parser) forgetRepeated(ctx map[string]interface{}, key string) {
+	delete(p.repeated, hashKey{reflect.ValueOf(ctx).Pointer(), key})
+}
+
+// mergeHashes merges src into dst, merging hashes within them that have the
+// same key in turn.
+func mergeHashes(dst, src map[string]interface{}) {
+	for k, v := range src {
+		dstHash, ok := dst[k].(map[string]interface{})
+		srcHash, isSrcHash := v.(map[string]interface{})
+		if ok && isSrcHash {
+			mergeHashes(dstHash, srcHash)
+			continue
+		}
+		dst[k] = v
+	}
+}
+
+func isSameHash(a, b interface{}) bool {
+	_, ok := a.(map[string]interface{})
+	_, isHash := b.(map[string]interface{})
+	return ok && isHash && reflect.ValueOf(a).Pointer() == reflect.ValueOf(b).Pointer()
+}
+
+// where describes the position of a key for an error about a key elsewhere.
+func (p *parser) where(pos Position) string {
+	if pos.File != p.file() && pos.File != "" {
+		return fmt.Sprintf("in '%s' on line %d, column %d", pos.File, pos.Key.Start.Line, pos.Key.Start.Column)
+	}
+	return fmt.Sprintf("on line %d, column %d", pos.Key.Start.Line, pos.Key.Start.Column)
+}
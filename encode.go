@@ -27,13 +27,29 @@ var (
 	_                         = u.EMPTY
 )
 
-var quotedReplacer = strings.NewReplacer(
-	"\t", "\\t",
-	"\n", "\\n",
-	"\r", "\\r",
-	"\"", "\\\"",
-	"\\", "\\\\",
-)
+var quotedReplacer = strings.NewReplacer(quotedEscapes()...)
+
+// quotedEscapes returns the pairs of strings and their escapes for quoted
+// strings. Control characters without an escape of their own are written
+// as `\u00XX`, and `${` is escaped so it isn't taken for a reference.
+func quotedEscapes() []string {
+	escapes := []string{
+		"\b", "\\b",
+		"\t", "\\t",
+		"\n", "\\n",
+		"\f", "\\f",
+		"\r", "\\r",
+		"\"", "\\\"",
+		"\\", "\\\\",
+		"${", "$${",
+	}
+	for c := rune(0); c < 0x20; c++ {
+		if !strings.ContainsRune("\b\t\n\f\r", c) {
+			escapes = append(escapes, string(c), fmt.Sprintf("\\u%04x", c))
+		}
+	}
+	return escapes
+}
 
 // Marshall a go struct into bytes
 func Marshal(v interface{}) ([]byte, error) {
@@ -170,6 +186,14 @@ func (enc *Encoder) eElement(rv reflect.Value) {
 		// encoding.TextMarshaler, but we need to always use UTC.
 		enc.wf(v.In(time.FixedZone("UTC", 0)).Format("2006-01-02T15:04:05Z"))
 		return
+	case Date, TimeOfDay, ByteSize:
+		// Special case, also before TextMarshaler, as these are written
+		// without quotes.
+		enc.wf(v.(fmt.Stringer).String())
+		return
+	case time.Duration:
+		enc.wf(formatDuration(v))
+		return
 	case TextMarshaler:
 		// Special case. Use text marshaler if it's available for this value.
 		if s, err := v.MarshalText(); err != nil {
@@ -401,6 +425,9 @@ func confTypeOfGo(rv reflect.Value) confType {
 	if isNil(rv) || !rv.IsValid() {
 		return nil
 	}
+	if rv.Type() == reflect.TypeOf(time.Duration(0)) {
+		return confDuration
+	}
 
 	switch rv.Kind() {
 	case reflect.Bool:
@@ -428,6 +455,10 @@ func confTypeOfGo(rv reflect.Value) confType {
 		switch rv.Interface().(type) {
 		case time.Time:
 			return confDatetime
+		case Date:
+			return confDate
+		case TimeOfDay:
+			return confTimeOfDay
 		case TextMarshaler:
 			return confString
 		default:
@@ -561,3 +592,16 @@ func isValidKeyName(s string) bool {
 	}
 	return true
 }
+
+// formatDuration writes a duration like time.Duration.String, without the
+// trailing zero units, e.g. `1h30m` rather than `1h30m0s`.
+func formatDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = s[:len(s)-2]
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = s[:len(s)-2]
+	}
+	return s
+}
@@ -160,6 +160,34 @@ func TestEncodeMany(t *testing.T) {
 			wantOutput: fmt.Sprintf("DatetimeSlice = [%s, %s]\n",
 				dateStr, dateStr),
 		},
+		{label: "durations",
+			input: struct {
+				Timeout time.Duration
+				Backoff []time.Duration
+			}{
+				90 * time.Minute,
+				[]time.Duration{time.Second, 2 * time.Hour, 1500 * time.Millisecond},
+			},
+			wantOutput: "Timeout = 1h30m\nBackoff = [1s, 2h, 1.5s]\n",
+		},
+		{label: "byte sizes",
+			input: struct {
+				Sizes []ByteSize
+			}{
+				[]ByteSize{0, 1000, 1024, 64 * MB, 2 * GB, 2e9, 1536, 1025},
+			},
+			wantOutput: "Sizes = [0, 1K, 1KB, 64MB, 2GB, 2G, 1536, 1025]\n",
+		},
+		{label: "dates and times of day",
+			input: struct {
+				Date  Date
+				Times []TimeOfDay
+			}{
+				Date{2024, time.January, 31},
+				[]TimeOfDay{{7, 30, 0, 0}, {23, 59, 59, 250000000}},
+			},
+			wantOutput: "Date = 2024-01-31\nTimes = [07:30:00, 23:59:59.25]\n",
+		},
 		{label: "nested arrays and slices",
 			input: struct {
 				SliceOfArrays         [][2]int
@@ -529,3 +557,22 @@ func ExampleEncoder_Encode() {
 	//   key2 = "val2"
 	// }
 }
+
+func TestEncodeEscapesRoundTrip(t *testing.T) {
+	type Config struct {
+		S []string
+	}
+	in := Config{[]string{
+		`quote " and backslash \`,
+		"newline\n tab\t return\r",
+		"controls \x00\x01\b\f\x1f\x7f",
+		"unicode é 😀  ",
+		"not a ${reference}",
+	}}
+	bs, err := Marshal(&in)
+	assert.Equal(t, nil, err)
+	var out Config
+	_, err = Decode(string(bs), &out)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, in, out, string(bs))
+}
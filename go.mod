@@ -0,0 +1,8 @@
+module github.com/lytics/confl
+
+go 1.16
+
+require (
+	github.com/araddon/gou v0.0.0-20190110011759-c797efecbb61
+	github.com/stretchr/testify v1.9.0
+)
@@ -0,0 +1,177 @@
+package confl
+
+import (
+	"io/fs"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Include directives pull the contents of other files into the hash they
+// appear in, just as if they had been written there:
+//
+//   server {
+//     include "conf.d/*.conf"
+//   }
+//
+// File names are relative to the file containing the directive, and may be
+// glob patterns, whose matches are included in lexical order. A pattern
+// matching nothing includes nothing, but a plain file name must exist.
+
+// includer finds and reads the files named by include directives, either
+// from the OS or from an fs.FS.
+type includer struct {
+	fsys fs.FS
+}
+
+// join returns the name of the file given in an include directive found in
+// the directory dir.
+func (in *includer) join(dir, name string) string {
+	if in.fsys != nil {
+		return path.Join(dir, name)
+	}
+	if filepath.IsAbs(name) {
+		return filepath.Clean(name)
+	}
+	return filepath.Join(dir, name)
+}
+
+// dir returns the directory of a file, which file names included from it are
+// relative to.
+func (in *includer) dir(file string) string {
+	if in.fsys != nil {
+		return path.Dir(file)
+	}
+	return filepath.Dir(file)
+}
+
+// files returns the files matching name, which may be a glob pattern.
+func (in *includer) files(name string) ([]string, error) {
+	if !strings.ContainsAny(name, "*?[") {
+		return []string{name}, nil
+	}
+	if in.fsys != nil {
+		return fs.Glob(in.fsys, name)
+	}
+	return filepath.Glob(name)
+}
+
+func (in *includer) read(file string) (string, error) {
+	var bs []byte
+	var err error
+	if in.fsys != nil {
+		bs, err = fs.ReadFile(in.fsys, file)
+	} else {
+		bs, err = ioutil.ReadFile(file)
+	}
+	return string(bs), err
+}
+
+// source is a file being parsed, either the data given to parse or an
+// included file.
+type source struct {
+	lx   *lexer
+	file string // the name of the file, or "" for data that isn't from one
+	dir  string // the directory file names included from it are relative to
+
+	// The size of the parser's stack of scopes when the source was started,
+	// below which its table headers can't go.
+	scopes int
+
+	// Files matched by an include directive in this source that are still
+	// to be parsed, in order.
+	pending []source
+}
+
+// newIncluder returns the includer for the given options, or nil if include
+// directives are not allowed.
+func newIncluder(opts DecodeOptions) *includer {
+	switch {
+	case opts.Safe:
+		return nil
+	case opts.IncludeFS != nil:
+		return &includer{fsys: opts.IncludeFS}
+	case opts.IncludeDir != "" || opts.file != "":
+		return &includer{}
+	}
+	return nil
+}
+
+// include handles an include directive naming the files in the string item
+// it, which are parsed one after the other once the parser moves on to the
+// next item.
+func (p *parser) include(it item) *ParseError {
+	if p.includer == nil {
+		return p.errorf(it.pos, "Cannot include '%s', includes are not enabled.", it.val)
+	}
+	src := &p.sources[len(p.sources)-1]
+	files, err := p.includer.files(p.includer.join(src.dir, it.val))
+	if err != nil {
+		return p.errorf(it.pos, "Cannot include '%s': %s", it.val, err)
+	}
+	for _, file := range files {
+		for _, s := range p.sources {
+			if s.file == file {
+				return p.errorf(it.pos, "Include cycle: %s", p.includeChain(file))
+			}
+		}
+		data, err := p.includer.read(file)
+		if err != nil {
+			return p.errorf(it.pos, "Cannot include '%s': %s", it.val, err)
+		}
+		lx := lex(data)
+		lx.recover = p.collect
+		lx.dialect = p.dialect
+		src.pending = append(src.pending, source{
+			lx:   lx,
+			file: file,
+			dir:  p.includer.dir(file),
+		})
+	}
+	p.nextSource()
+	return nil
+}
+
+// includeChain describes the files being included that lead back to file.
+func (p *parser) includeChain(file string) string {
+	var chain []string
+	for _, s := range p.sources {
+		if s.file != "" {
+			chain = append(chain, s.file)
+		}
+	}
+	return strings.Join(append(chain, file), " -> ")
+}
+
+// nextSource starts parsing the next file pending in the current source,
+// if there is one.
+func (p *parser) nextSource() {
+	src := &p.sources[len(p.sources)-1]
+	if len(src.pending) == 0 {
+		return
+	}
+	next := src.pending[0]
+	src.pending = src.pending[1:]
+	next.scopes = len(p.scopes)
+	p.sources = append(p.sources, next)
+	p.lx = next.lx
+}
+
+// endSource goes back to the source that included the current one, once it
+// has been parsed. It returns false if there is nothing to go back to.
+func (p *parser) endSource() bool {
+	if len(p.sources) <= 1 {
+		return false
+	}
+	p.leaveTables()
+	p.sources = p.sources[:len(p.sources)-1]
+	p.lx = p.sources[len(p.sources)-1].lx
+	p.nextSource()
+	return true
+}
+
+// file returns the name of the file being parsed, if any.
+func (p *parser) file() string {
+	return p.sources[len(p.sources)-1].file
+}
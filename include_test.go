@@ -0,0 +1,246 @@
+package confl
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+var includeFS = fstest.MapFS{
+	"main.conf": {Data: []byte(`
+name = main
+include "common.conf"
+server {
+  port = 80
+  include "conf.d/*.conf"
+}
+`)},
+	"common.conf": {Data: []byte(`
+log_level = debug
+`)},
+	"conf.d/a.conf": {Data: []byte(`
+host = a
+tls { enabled = true }
+`)},
+	"conf.d/b.conf": {Data: []byte(`
+host = b
+include "../shared/limits.conf"
+`)},
+	"shared/limits.conf": {Data: []byte(`
+max_conns = 10
+`)},
+	"conf.d/notes.txt": {Data: []byte(`not included`)},
+}
+
+func TestInclude(t *testing.T) {
+	var v map[string]interface{}
+	md, err := DecodeWithOptions(`include "main.conf"`, &v, DecodeOptions{IncludeFS: includeFS})
+	if err != nil {
+		t.Fatalf("Received err: %v\n", err)
+	}
+	ex := map[string]interface{}{
+		"name":      "main",
+		"log_level": "debug",
+		"server": map[string]interface{}{
+			"port": int64(80),
+			// b.conf is included after a.conf, so its host wins.
+			"host":      "b",
+			"tls":       map[string]interface{}{"enabled": true},
+			"max_conns": int64(10),
+		},
+	}
+	if !reflect.DeepEqual(v, ex) {
+		t.Fatalf("Not Equal:\nReceived: '%+v'\nExpected: '%+v'\n", v, ex)
+	}
+
+	keys := []string{}
+	for _, key := range md.Keys() {
+		keys = append(keys, key.String())
+	}
+	exKeys := []string{
+		"name", "log_level", "server", "server.port", "server.host",
+		"server.tls", "server.tls.enabled", "server.host", "server.max_conns",
+	}
+	if !reflect.DeepEqual(keys, exKeys) {
+		t.Fatalf("Expected keys %v, but got %v", exKeys, keys)
+	}
+
+	files := map[string]string{
+		"name":               "main.conf",
+		"log_level":          "common.conf",
+		"server":             "main.conf",
+		"server.port":        "main.conf",
+		"server.tls.enabled": "conf.d/a.conf",
+		"server.host":        "conf.d/b.conf",
+		"server.max_conns":   "shared/limits.conf",
+	}
+	for key, file := range files {
+		pos := md.Position(strings.Split(key, ".")...)
+		if pos.File != file {
+			t.Errorf("Expected %s to be from '%s', but got '%s'", key, file, pos.File)
+		}
+	}
+	if pos := md.Position("server", "max_conns"); pos.Key.Start != (Pos{2, 1}) {
+		t.Errorf("Expected server.max_conns at 2:1, but got %s", pos.Key.Start)
+	}
+}
+
+func TestIncludeErrors(t *testing.T) {
+	fsys := fstest.MapFS{
+		"loop.conf":  {Data: []byte("a = 1\ninclude \"loop2.conf\"\n")},
+		"loop2.conf": {Data: []byte("b = 2\ninclude 'loop.conf'\n")},
+		"bad.conf":   {Data: []byte("a = 1\nb = 99999999999999999999\n")},
+	}
+	tests := []struct {
+		data string
+		opts DecodeOptions
+		file string
+		line int
+		msg  string
+	}{
+		{`include "a.conf"`, DecodeOptions{}, "", 1,
+			"Cannot include 'a.conf', includes are not enabled."},
+		{`include "missing.conf"`, DecodeOptions{IncludeFS: fsys}, "", 1,
+			"Cannot include 'missing.conf': open missing.conf: file does not exist"},
+		{"x = 1\ninclude \"loop.conf\"", DecodeOptions{IncludeFS: fsys}, "loop2.conf", 2,
+			"Include cycle: loop.conf -> loop2.conf -> loop.conf"},
+		{`include "bad.conf"`, DecodeOptions{IncludeFS: fsys}, "bad.conf", 2,
+			"Integer '99999999999999999999' is out of the range."},
+		{`include {}`, DecodeOptions{IncludeFS: fsys}, "", 0, ""},
+	}
+	for _, test := range tests {
+		var v map[string]interface{}
+		_, err := DecodeWithOptions(test.data, &v, test.opts)
+		if test.msg == "" {
+			if err != nil {
+				t.Errorf("Received err for %q: %v", test.data, err)
+			}
+			continue
+		}
+		pe, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("Expected a ParseError for %q, but got %T: %v", test.data, err, err)
+			continue
+		}
+		if pe.File != test.file || pe.Line != test.line || pe.Msg != test.msg {
+			t.Errorf("Expected %s:%d: %s\nbut got %s:%d: %s",
+				test.file, test.line, test.msg, pe.File, pe.Line, pe.Msg)
+		}
+	}
+}
+
+func TestIncludeKeyword(t *testing.T) {
+	// include is still a key when used like one.
+	test(t, "include = yes\nfoo { include: 1, include [2] }\nbar { include {} }", map[string]interface{}{
+		"include": "yes",
+		"foo":     map[string]interface{}{"include": []interface{}{int64(2)}},
+		"bar":     map[string]interface{}{"include": map[string]interface{}{}},
+	})
+}
+
+func TestDecodeFileInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "confl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"app.conf":        "name = app\ndb {\n  .include \"db/*.conf\"\n}\n",
+		"db/primary.conf": "host = localhost\nport = 5432\n",
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var conf struct {
+		Name string
+		DB   struct {
+			Host string
+			Port int
+		}
+	}
+	md, err := DecodeFile(filepath.Join(dir, "app.conf"), &conf)
+	if err != nil {
+		t.Fatalf("Received err: %v\n", err)
+	}
+	if conf.Name != "app" || conf.DB.Host != "localhost" || conf.DB.Port != 5432 {
+		t.Fatalf("Unexpected config: %+v", conf)
+	}
+	if file := md.Position("db", "port").File; file != filepath.Join(dir, "db", "primary.conf") {
+		t.Fatalf("Expected db.port to be from db/primary.conf, but got '%s'", file)
+	}
+
+	// Includes are resolved against IncludeDir for data that isn't from a file.
+	var v map[string]interface{}
+	_, err = DecodeWithOptions(`include "db/primary.conf"`, &v, DecodeOptions{IncludeDir: dir})
+	if err != nil {
+		t.Fatalf("Received err: %v\n", err)
+	}
+	if v["host"] != "localhost" {
+		t.Fatalf("Expected host from the included file, but got %v", v)
+	}
+}
+
+func TestIncludeDuplicateKeys(t *testing.T) {
+	fsys := fstest.MapFS{"base.conf": {Data: []byte("name = base\n")}}
+	var v map[string]interface{}
+	_, err := DecodeWithOptions("include \"base.conf\"\nname = main", &v,
+		DecodeOptions{IncludeFS: fsys, DuplicateKeys: DuplicateError})
+	pe, ok := err.(*ParseError)
+	if !ok || pe.Line != 2 || pe.Msg != "Key 'name' is already defined in 'base.conf' on line 1, column 1." {
+		t.Fatalf("Expected a duplicate key error, but got %v", err)
+	}
+}
+
+func TestIncludeJSON(t *testing.T) {
+	fsys := fstest.MapFS{
+		"db.json":    {Data: []byte(`{"host": "localhost", "port": 5432}`)},
+		"hosts.json": {Data: []byte(`["a", "b"]`)},
+	}
+	var v map[string]interface{}
+	_, err := DecodeWithOptions("db {\n  include \"db.json\"\n}", &v,
+		DecodeOptions{IncludeFS: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex := map[string]interface{}{"host": "localhost", "port": int64(5432)}
+	if !reflect.DeepEqual(v["db"], ex) {
+		t.Fatalf("Not Equal:\nReceived: '%+v'\nExpected: '%+v'\n", v["db"], ex)
+	}
+
+	_, err = DecodeWithOptions("include \"hosts.json\"", &v, DecodeOptions{IncludeFS: fsys})
+	pe, ok := err.(*ParseError)
+	if !ok || pe.File != "hosts.json" || pe.Msg != "An included file cannot be an array." {
+		t.Fatalf("Expected an error for an included array, but got %v", err)
+	}
+}
+
+func TestIncludeTables(t *testing.T) {
+	fsys := fstest.MapFS{"db.toml": {Data: []byte("[primary]\nhost = a\n[replica]\nhost = b\n")}}
+	var v map[string]interface{}
+	_, err := DecodeWithOptions("db {\n  include \"db.toml\"\n  name = main\n}", &v,
+		DecodeOptions{IncludeFS: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex := map[string]interface{}{
+		"db": map[string]interface{}{
+			"primary": map[string]interface{}{"host": "a"},
+			"replica": map[string]interface{}{"host": "b"},
+			"name":    "main",
+		},
+	}
+	if !reflect.DeepEqual(v, ex) {
+		t.Fatalf("Not Equal:\nReceived: '%+v'\nExpected: '%+v'\n", v, ex)
+	}
+}
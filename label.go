@@ -0,0 +1,74 @@
+package confl
+
+import (
+	"reflect"
+	"sort"
+)
+
+// labeledBlock is a block found under the labels of a hash made by labeled
+// blocks, such as `backend "s3" "primary" { }`.
+type labeledBlock struct {
+	labels []string
+	key    Key
+	data   interface{}
+}
+
+// unifyLabeled decodes the blocks of a hash made by labeled blocks into a
+// slice of structs, in the order they were written, setting the fields
+// tagged `confl:",label"` of each to its labels, in order.
+func (md *MetaData) unifyLabeled(tmap map[string]interface{}, rv reflect.Value, labels []field) error {
+	var blocks []labeledBlock
+	if err := md.labeledBlocks(tmap, md.context, nil, len(labels), &blocks); err != nil {
+		return err
+	}
+	sort.SliceStable(blocks, func(i, j int) bool {
+		a := md.positions[blocks[i].key.String()].Key.Start
+		b := md.positions[blocks[j].key.String()].Key.Start
+		return a.Line < b.Line || a.Line == b.Line && a.Column < b.Column
+	})
+
+	rv.Set(reflect.MakeSlice(rv.Type(), len(blocks), len(blocks)))
+	context := md.context
+	defer func() { md.context = context }()
+	for i, b := range blocks {
+		elem := indirect(rv.Index(i))
+		for j, f := range labels {
+			subv := elem
+			for _, k := range f.index[:len(f.index)-1] {
+				subv = indirect(subv.Field(k))
+			}
+			subv = indirect(subv.Field(f.index[len(f.index)-1]))
+			if subv.Kind() != reflect.String {
+				return e("Label field '%s.%s' must be a string.", elem.Type(), f.name)
+			}
+			subv.SetString(b.labels[j])
+		}
+		md.context = b.key
+		if err := md.unify(b.data, elem); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// labeledBlocks adds the blocks found depth labels down in tmap to blocks,
+// marking them and the hashes for the labels on the way as decoded.
+func (md *MetaData) labeledBlocks(tmap map[string]interface{}, context Key, labels []string, depth int, blocks *[]labeledBlock) error {
+	for label, datum := range tmap {
+		key := context.add(label)
+		ls := append(labels[:len(labels):len(labels)], label)
+		md.decoded[key.String()] = true
+		if depth == 1 {
+			*blocks = append(*blocks, labeledBlock{ls, key, datum})
+			continue
+		}
+		hash, ok := datum.(map[string]interface{})
+		if !ok {
+			return e("Expected %d labels for the block '%s'.", len(ls)+depth-1, key)
+		}
+		if err := md.labeledBlocks(hash, key, ls, depth-1, blocks); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -17,6 +17,7 @@ package confl
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 	"unicode"
 	"unicode/utf8"
@@ -24,6 +25,9 @@ import (
 
 var (
 	// IdentityChars Which Identity Characters are allowed?
+	//
+	// Deprecated: Set the IdentifierChars of DecodeOptions.Dialect instead.
+	// IdentityChars is only used by LegacyDialect.
 	IdentityChars = "_."
 )
 
@@ -40,11 +44,31 @@ const (
 	itemInteger
 	itemFloat
 	itemDatetime
+	itemDate
+	itemTime
+	itemDuration
 	itemArrayStart
 	itemArrayEnd
 	itemMapStart
 	itemMapEnd
 	itemCommentStart
+	itemInclude
+	itemVariable
+	itemRawString // a string that is used exactly as written
+	itemNull
+	itemQuotedKey       // a key that is used exactly as written
+	itemBlockString     // a multi-line string with no escapes
+	itemHeredoc         // a multi-line string that is used exactly as written
+	itemIndentedHeredoc // a heredoc with the indentation of its lines removed
+	itemTable           // the name of a table header, `[name]`
+	itemArrayTable      // the name of an array of tables header, `[[name]]`
+	itemLabel           // a label of a block, `key "label" { }`
+	itemArgsStart       // the start of the arguments of a directive
+	itemArgsEnd         // the end of the arguments of a directive
+	itemOperator        // an operator changing the value of a key, `+=` or `^=`
+	itemUnset           // the deletion of the key that follows, `-` or `unset`
+	itemProfile         // the profile of the section that follows, `@name`
+	itemQuotedString    // a double-quoted string, whose escapes are decoded
 )
 
 const (
@@ -59,6 +83,7 @@ const (
 	mapValTerm        = ','
 	commentHashStart  = '#'
 	commentSlashStart = '/'
+	commentBlockStar  = '*'
 	dqStringStart     = '"'
 	dqStringEnd       = '"'
 	sqStringStart     = '\''
@@ -66,6 +91,13 @@ const (
 	optValTerm        = ';'
 	blockStart        = '('
 	blockEnd          = ')'
+	heredocStart      = '<'
+	heredocIndent     = '-'
+	variableStart     = '$'
+	keyUnset          = '-'
+	profileStart      = '@'
+	opAppend          = "+="
+	opPrepend         = "^="
 )
 
 type stateFn func(lx *lexer) stateFn
@@ -81,6 +113,24 @@ type lexer struct {
 	circuitBreaker int
 	isEnd          func(lx *lexer, r rune) bool
 
+	// The byte offsets at which each line of input starts, in order, as far
+	// as the input has been consumed. Used to find the line and column of
+	// an item.
+	lineStarts []int
+
+	// The hashes and arrays currently open, as itemMapStart or
+	// itemArrayStart, innermost last.
+	containers []itemType
+
+	// Whether to resume lexing after an error rather than stop.
+	recover bool
+
+	// Whether the whole input is a single object or array, as in JSON.
+	root bool
+
+	// The syntax to accept.
+	dialect Dialect
+
 	// A stack of state functions used to maintain context.
 	// The idea is to reuse parts of the state machine in various places.
 	// For example, values can appear at the top level or within arbitrarily
@@ -93,27 +143,53 @@ type item struct {
 	typ  itemType
 	val  string
 	line int
+
+	// The exact start and end of the item in the input.
+	pos Pos
+	end Pos
+}
+
+// span returns the range of input the item was lexed from.
+func (it item) span() Span {
+	return Span{it.pos, it.end}
 }
 
+// maxStuckStates is how many states the lexer may pass through without
+// consuming any input before it is considered stuck.
+const maxStuckStates = 1000
+
 func (lx *lexer) nextItem() item {
 	for {
 		select {
 		case item := <-lx.items:
 			return item
 		default:
+			if lx.state == nil {
+				// Lexing has already stopped on an error or EOF.
+				pos := lx.position(lx.pos)
+				return item{itemEOF, "", lx.line, pos, pos}
+			}
+			pos := lx.pos
 			lx.state = lx.state(lx)
+			if lx.pos != pos {
+				lx.circuitBreaker = 0
+			} else if lx.circuitBreaker++; lx.circuitBreaker > maxStuckStates {
+				lx.state = lx.errorf("BUG in lexer: stuck at '%v'.", lx.peek())
+			}
 		}
 	}
 }
 
 func lex(input string) *lexer {
 	lx := &lexer{
-		input: input,
-		state: lexTop,
-		line:  1,
-		items: make(chan item, 10),
-		stack: make([]stateFn, 0, 10),
-		isEnd: isEndNormal,
+		input:      input,
+		state:      lexRoot,
+		line:       1,
+		items:      make(chan item, 10),
+		stack:      make([]stateFn, 0, 10),
+		isEnd:      isEndNormal,
+		lineStarts: []int{0},
+		dialect:    DecodeOptions{}.dialect(),
 	}
 	return lx
 }
@@ -133,10 +209,77 @@ func (lx *lexer) pop() stateFn {
 }
 
 func (lx *lexer) emit(typ itemType) {
-	lx.items <- item{typ, lx.input[lx.start:lx.pos], lx.line}
+	lx.track(typ)
+	lx.items <- item{typ, lx.input[lx.start:lx.pos], lx.line,
+		lx.position(lx.start), lx.position(lx.pos)}
 	lx.start = lx.pos
 }
 
+// emitEmpty emits an item without a value that still spans the pending
+// input, such as the '{' starting a map.
+func (lx *lexer) emitEmpty(typ itemType) {
+	lx.track(typ)
+	lx.items <- item{typ, "", lx.line,
+		lx.position(lx.start), lx.position(lx.pos)}
+	lx.start = lx.pos
+}
+
+// track keeps note of the hashes, arrays and directive arguments opened and
+// closed by an item.
+func (lx *lexer) track(typ itemType) {
+	switch typ {
+	case itemMapStart, itemArrayStart, itemArgsStart:
+		lx.containers = append(lx.containers, typ)
+	case itemMapEnd, itemArrayEnd, itemArgsEnd:
+		if len(lx.containers) > 0 {
+			lx.containers = lx.containers[0 : len(lx.containers)-1]
+		}
+	default:
+		return
+	}
+	lx.setEnd()
+}
+
+// setEnd chooses what ends an unquoted value in the innermost container.
+// Only hashes in a document that is a single object, like JSON, end them at
+// a ',' or '}', so that blocks elsewhere keep values like `a,b`. The
+// arguments of a directive end with the hash they are in.
+func (lx *lexer) setEnd() {
+	c := lx.containers
+	if len(c) > 0 && c[len(c)-1] == itemArgsStart {
+		c = c[:len(c)-1]
+	}
+	switch {
+	case len(c) == 0:
+		lx.isEnd = isEndNormal
+	case c[len(c)-1] == itemArrayStart:
+		lx.isEnd = isEndArrayUnQuoted
+	case c[len(c)-1] == itemMapStart && lx.root:
+		lx.isEnd = isEndMapUnQuoted
+	default:
+		lx.isEnd = isEndNormal
+	}
+}
+
+// container returns the innermost open hash, array or directive arguments,
+// or itemNIL at the top level.
+func (lx *lexer) container() itemType {
+	if len(lx.containers) == 0 {
+		return itemNIL
+	}
+	return lx.containers[len(lx.containers)-1]
+}
+
+// position returns the line and column of a byte offset in the input that
+// has already been consumed.
+func (lx *lexer) position(offset int) Pos {
+	i := sort.Search(len(lx.lineStarts), func(i int) bool {
+		return lx.lineStarts[i] > offset
+	}) - 1
+	col := utf8.RuneCountInString(lx.input[lx.lineStarts[i]:offset]) + 1
+	return Pos{Line: i + 1, Column: col}
+}
+
 func (lx *lexer) next() (r rune) {
 
 	// stackBuf := make([]byte, 4096)
@@ -157,6 +300,9 @@ func (lx *lexer) next() (r rune) {
 
 	if lx.input[lx.pos] == '\n' {
 		lx.line++
+		if lx.pos+1 > lx.lineStarts[len(lx.lineStarts)-1] {
+			lx.lineStarts = append(lx.lineStarts, lx.pos+1)
+		}
 	}
 	r, lx.width = utf8.DecodeRuneInString(lx.input[lx.pos:])
 	lx.pos += lx.width
@@ -186,10 +332,22 @@ func (lx *lexer) peek() rune {
 	return r
 }
 
-// errorf stops all lexing by emitting an error and returning `nil`.
+// errorf stops all lexing by emitting an error and returning `nil`, or
+// when recovering from errors, moves on to lexRecover.
+// The error is positioned at the last rune read.
 // Note that any value that is a character is escaped if it's a special
 // character (new lines, tabs, etc.).
 func (lx *lexer) errorf(format string, values ...interface{}) stateFn {
+	offset := lx.pos - lx.width
+	if offset < 0 {
+		offset = 0
+	}
+	return lx.errorAt(offset, format, values...)
+}
+
+// errorAt is like errorf, but positions the error at the given offset in
+// the input, such as the start of something left unterminated.
+func (lx *lexer) errorAt(offset int, format string, values ...interface{}) stateFn {
 	for i, value := range values {
 		if v, ok := value.(rune); ok {
 			values[i] = escapeSpecial(v)
@@ -199,11 +357,142 @@ func (lx *lexer) errorf(format string, values ...interface{}) stateFn {
 		itemError,
 		fmt.Sprintf(format, values...),
 		lx.line,
+		lx.position(offset),
+		lx.position(lx.pos),
+	}
+	if lx.recover {
+		if lx.container() == itemArgsStart {
+			// The arguments so far are kept, and the rest of the line is
+			// skipped along with the bad one.
+			lx.emitEmpty(itemArgsEnd)
+		}
+		return lexRecover
 	}
 	return nil
 }
 
+// lexRecover resumes lexing after an error. It skips the rest of the bad
+// line, or up to the end of the hash or array it is in, and then carries on
+// as if the bad input was never there.
+func lexRecover(lx *lexer) stateFn {
+	r := lx.next()
+	switch {
+	case r == eof:
+		lx.ignore()
+		lx.emit(itemEOF)
+		return nil
+	case isNL(r):
+		lx.ignore()
+		lx.resetStack()
+		switch lx.container() {
+		case itemMapStart:
+			return lexMapKeyStart
+		case itemArrayStart:
+			return lexArrayValue
+		}
+		if lx.root {
+			return lexRootEnd
+		}
+		return lexTop
+	case r == mapEnd && lx.container() == itemMapStart:
+		lx.resetStack()
+		return lexMapEnd
+	case r == arrayEnd && lx.container() == itemArrayStart:
+		lx.resetStack()
+		return lexArrayEnd
+	}
+	return lexRecover
+}
+
+// resetStack rebuilds the stack of states from the open hashes and arrays,
+// dropping whatever the bad input left on it.
+func (lx *lexer) resetStack() {
+	lx.stack = lx.stack[0:0]
+	parent := itemNIL
+	for _, c := range lx.containers {
+		switch parent {
+		case itemMapStart:
+			lx.push(lexMapValueEnd)
+		case itemArrayStart:
+			lx.push(lexArrayValueEnd)
+		case itemArgsStart:
+			lx.push(lexArgsEnd)
+		default:
+			if lx.root {
+				lx.push(lexRootEnd)
+			} else {
+				lx.push(lexTopValueEnd)
+			}
+		}
+		parent = c
+	}
+	lx.setEnd()
+}
+
 // lexTop consumes elements at the top level of data.
+// lexRoot consumes the start of the input, up to its first key, or the '{'
+// or '[' of input that is a single object or array, like a JSON document.
+func lexRoot(lx *lexer) stateFn {
+	r := lx.next()
+	switch {
+	case isWhitespace(r) || isNL(r):
+		return lexSkip(lx, lexRoot)
+	case r == commentHashStart:
+		lx.push(lexRoot)
+		return lexCommentStart
+	case r == commentSlashStart && strings.HasPrefix(lx.input[lx.pos:], string(commentSlashStart)):
+		lx.next()
+		lx.push(lexRoot)
+		return lexCommentStart
+	case lx.atBlockComment(r):
+		lx.next()
+		lx.push(lexRoot)
+		return lexBlockCommentStart
+	case r == arrayStart && lx.dialect.TopLevelKeys && isTableHeaderAhead(lx.input[lx.pos:]):
+		return lexTableStart
+	case r == mapStart:
+		lx.root = true
+		lx.emitEmpty(itemMapStart)
+		lx.push(lexRootEnd)
+		return lexMapKeyStart
+	case r == arrayStart:
+		lx.root = true
+		lx.emitEmpty(itemArrayStart)
+		lx.push(lexRootEnd)
+		return lexArrayValue
+	case r != eof && !lx.dialect.TopLevelKeys:
+		return lx.errorf("Expected an object or array, but got '%v' instead.", r)
+	}
+	lx.backup()
+	return lexTop
+}
+
+// lexRootEnd consumes the rest of the input after the object or array that
+// is the whole of it, where only comments are allowed.
+func lexRootEnd(lx *lexer) stateFn {
+	r := lx.next()
+	switch {
+	case isWhitespace(r) || isNL(r):
+		return lexSkip(lx, lexRootEnd)
+	case r == commentHashStart:
+		lx.push(lexRootEnd)
+		return lexCommentStart
+	case r == commentSlashStart && strings.HasPrefix(lx.input[lx.pos:], string(commentSlashStart)):
+		lx.next()
+		lx.push(lexRootEnd)
+		return lexCommentStart
+	case lx.atBlockComment(r):
+		lx.next()
+		lx.push(lexRootEnd)
+		return lexBlockCommentStart
+	case r == eof:
+		lx.emit(itemEOF)
+		return nil
+	}
+	return lx.errorf("Expected the end of the input after its top-level "+
+		"object or array, but got '%v' instead.", r)
+}
+
 func lexTop(lx *lexer) stateFn {
 	r := lx.next()
 	if r != eof && (isWhitespace(r) || isNL(r)) {
@@ -219,6 +508,10 @@ func lexTop(lx *lexer) stateFn {
 			lx.push(lexTop)
 			return lexCommentStart
 		}
+		if rn == commentBlockStar {
+			lx.push(lexTop)
+			return lexBlockCommentStart
+		}
 		lx.backup()
 		fallthrough
 	case r == eof:
@@ -227,6 +520,12 @@ func lexTop(lx *lexer) stateFn {
 		}
 		lx.emit(itemEOF)
 		return nil
+	case r == arrayStart:
+		return lexTableStart
+	case r == profileStart && !lx.isIdentifierRune(r):
+		lx.ignore()
+		lx.push(lexTopValueEnd)
+		return lexProfile
 	}
 
 	// At this point, the only valid item can be a key, so we back up
@@ -236,6 +535,113 @@ func lexTop(lx *lexer) stateFn {
 	return lexKeyStart
 }
 
+// isTableHeaderAhead returns true if s, following a '[' at the start of the
+// input, is the rest of a table header, like `db.primary]`, `"a.b"]` or
+// `[servers]]`, rather than of an array. Its name is read as splitTableName
+// reads it, but its bare keys may only hold the runes of keys, so that an
+// array such as `[1, 2]` or `[{"a": 1}]` isn't taken for one.
+func isTableHeaderAhead(s string) bool {
+	end := string(arrayEnd)
+	if strings.HasPrefix(s, string(arrayStart)) {
+		s, end = s[1:], end+end
+	}
+	var quote rune
+	for i, r := range s {
+		switch {
+		case isNL(r):
+			return false
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == dqStringStart || r == sqStringStart:
+			quote = r
+		case strings.HasPrefix(s[i:], end):
+			if _, err := splitTableName(s[:i]); err != nil {
+				return false
+			}
+			rest := strings.TrimLeft(s[i+len(end):], " \t")
+			return rest == "" || isNL(rune(rest[0])) || rest[0] == commentHashStart
+		case !isIdentifierRune(r, "_-. \t"):
+			return false
+		}
+	}
+	return false
+}
+
+// lexTableStart consumes a table header, `[name]`, or an array of tables
+// header, `[[name]]`, and emits its name as it is written. It assumes that
+// the first '[' has already been consumed.
+func lexTableStart(lx *lexer) stateFn {
+	typ, end := itemTable, string(arrayEnd)
+	if strings.HasPrefix(lx.input[lx.pos:], string(arrayStart)) {
+		lx.next()
+		typ, end = itemArrayTable, end+end
+	}
+	lx.ignore()
+	var quote rune
+	var lexTable stateFn
+	lexTable = func(lx *lexer) stateFn {
+		r := lx.next()
+		switch {
+		case isNL(r) || r == eof:
+			return lx.errorf("Unterminated table header, expected '%s'.", end)
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == dqStringStart || r == sqStringStart:
+			quote = r
+		case r == arrayEnd:
+			lx.backup()
+			if !strings.HasPrefix(lx.input[lx.pos:], end) {
+				lx.next()
+				return lx.errorf("Expected '%s' to end the table header.", end)
+			}
+			lx.emit(typ)
+			lx.pos += len(end)
+			lx.ignore()
+			return lexTopValueEnd
+		}
+		return lexTable
+	}
+	return lexTable
+}
+
+// lexProfile consumes the profile of a section, `@production` or
+// `@env(staging, production)`, and emits it as it is written, without the
+// '@'. It assumes that the '@' has already been consumed and ignored.
+func lexProfile(lx *lexer) stateFn {
+	r := lx.next()
+	switch {
+	case r == blockStart:
+		for r = lx.next(); r != blockEnd; r = lx.next() {
+			if isNL(r) || r == eof {
+				return lx.errorf("Unterminated profile, expected '%v'.", blockEnd)
+			}
+		}
+	case isWhitespace(r) || isNL(r) || r == eof || r == mapStart:
+		lx.backup()
+		lx.emit(itemProfile)
+		return lexProfileEnd
+	}
+	return lexProfile
+}
+
+// lexProfileEnd consumes the whitespace between the profile of a section and
+// the '{' starting its hash.
+func lexProfileEnd(lx *lexer) stateFn {
+	r := lx.next()
+	switch {
+	case isWhitespace(r):
+		return lexSkip(lx, lexProfileEnd)
+	case r == mapStart:
+		lx.backup()
+		return lexValue
+	}
+	return lx.errorf("Expected '{' to start the section of a profile, but got '%v' instead.", r)
+}
+
 // lexTopValueEnd is entered whenever a top-level value has been consumed.
 // It must see only whitespace, and will turn back to lexTop upon a new line.
 // If it sees EOF, it will quit the lexer successfully.
@@ -252,6 +658,12 @@ func lexTopValueEnd(lx *lexer) stateFn {
 			lx.push(lexTop)
 			return lexCommentStart
 		}
+		if rn == commentBlockStar {
+			// A block comment doesn't end the value, so the line must still
+			// end after it.
+			lx.push(lexTopValueEnd)
+			return lexBlockCommentStart
+		}
 		lx.backup()
 		fallthrough
 	case isWhitespace(r):
@@ -270,6 +682,7 @@ func lexKeyStart(lx *lexer) stateFn {
 	r := lx.peek()
 	switch {
 	case isKeySeparator(r):
+		lx.next()
 		return lx.errorf("Unexpected key separator '%v'.", r)
 	case isWhitespace(r) || isNL(r):
 		// Most likely this is not-reachable, as the lexTop already checks for it.
@@ -281,13 +694,20 @@ func lexKeyStart(lx *lexer) stateFn {
 	case r == sqStringStart:
 		lx.next()
 		return lexSkip(lx, lexQuotedKey)
-	case !isIdentifierRune(r):
+	case r == eof:
+		return lexTop
+	case r == keyUnset && lx.dialect.Operators:
+		lx.next()
+		lx.emit(itemUnset)
+		return lexUnsetKey
+	case !lx.isIdentifierRune(r):
 		// This is not a valid identity/key rune
 		lx.next()
 		lx.ignore()
 		return lexKeyStart
-	case r == eof:
-		return lexTop
+	case !lx.dialect.UnquotedKeys:
+		lx.next()
+		return lx.errorf("Expected a quoted key, but got '%v' instead.", r)
 	}
 	lx.ignore()
 	lx.next()
@@ -297,8 +717,11 @@ func lexKeyStart(lx *lexer) stateFn {
 // lexDubQuotedKey consumes the text of a key between quotes.
 func lexDubQuotedKey(lx *lexer) stateFn {
 	r := lx.peek()
+	if r == eof {
+		return lx.errorf("Unexpected EOF in quoted key.")
+	}
 	if r == dqStringEnd {
-		lx.emit(itemKey)
+		lx.emit(itemQuotedKey)
 		lx.next()
 		return lexSkip(lx, lexKeyEnd)
 	}
@@ -309,8 +732,11 @@ func lexDubQuotedKey(lx *lexer) stateFn {
 // lexQuotedKey consumes the text of a key between quotes.
 func lexQuotedKey(lx *lexer) stateFn {
 	r := lx.peek()
+	if r == eof {
+		return lx.errorf("Unexpected EOF in quoted key.")
+	}
 	if r == sqStringEnd {
-		lx.emit(itemKey)
+		lx.emit(itemQuotedKey)
 		lx.next()
 		return lexSkip(lx, lexKeyEnd)
 	}
@@ -326,24 +752,116 @@ func lexKey(lx *lexer) stateFn {
 	case r == eof:
 		// Unexpected end, allow lexTop eof/error to handle it
 		return lexTop
-	case isWhitespace(r) || isNL(r) || isKeySeparator(r):
-		lx.emit(itemKey)
+	case isWhitespace(r) || isNL(r) || isKeySeparator(r) || lx.isDirectiveEnd(r) ||
+		lx.isOperator(lx.input[lx.pos:]):
+		switch lx.emitKey() {
+		case itemInclude:
+			return lexValue
+		case itemUnset:
+			return lexUnsetKey
+		}
 		return lexKeyEnd
 	}
 	lx.next()
 	return lexKey
 }
 
+// emitKey emits the unquoted key just consumed, and returns the type of
+// item emitted. The include and unset keywords are emitted as an include
+// directive and a deletion instead, unless they are followed by a key
+// separator, operator, hash, array or ';', so that they can still be used as
+// keys.
+func (lx *lexer) emitKey() itemType {
+	key := lx.input[lx.start:lx.pos]
+	rest := strings.TrimLeft(lx.input[lx.pos:], " \t")
+	typ := itemKey
+	switch {
+	case rest == "" || isNL(rune(rest[0])) || strings.IndexByte("=:{[;", rest[0]) >= 0 ||
+		lx.isOperator(rest):
+	case key == "include" || key == ".include":
+		typ = itemInclude
+	case key == "unset" && lx.dialect.Operators:
+		typ = itemUnset
+	}
+	lx.emit(typ)
+	return typ
+}
+
+// isOperator returns true if s starts with an operator changing the value
+// of a key, and the dialect allows them.
+func (lx *lexer) isOperator(s string) bool {
+	return lx.dialect.Operators && (strings.HasPrefix(s, opAppend) || strings.HasPrefix(s, opPrepend))
+}
+
+// lexUnsetKey consumes the key deleted by `-key` or `unset key`, which is
+// all there is to the deletion, and then goes on to the state on the stack.
+func lexUnsetKey(lx *lexer) stateFn {
+	r := lx.next()
+	switch {
+	case isWhitespace(r):
+		return lexSkip(lx, lexUnsetKey)
+	case r == dqStringStart || r == sqStringStart:
+		lx.ignore()
+		for rn := lx.next(); rn != r; rn = lx.next() {
+			if rn == eof {
+				return lx.errorf("Unexpected EOF in quoted key.")
+			}
+		}
+		lx.backup()
+		lx.emit(itemQuotedKey)
+		lx.next()
+		lx.ignore()
+		return lx.pop()
+	case isUnsetKeyEnd(r):
+		return lx.errorf("Expected a key to delete, but got '%v' instead.", r)
+	}
+	for !isUnsetKeyEnd(r) {
+		r = lx.next()
+	}
+	lx.backup()
+	lx.emit(itemKey)
+	return lx.pop()
+}
+
+func isUnsetKeyEnd(r rune) bool {
+	return isWhitespace(r) || isNL(r) || r == eof || r == optValTerm ||
+		r == mapEnd || r == mapValTerm || r == commentHashStart
+}
+
 // lexKeyEnd consumes the end of a key (up to the key separator).
 // Assumes that the first whitespace character after a key (or the '=' or ':'
 // separator) has NOT been consumed.
 func lexKeyEnd(lx *lexer) stateFn {
 	r := lx.next()
 	switch {
+	case lx.dialect.Directives && lx.isArgsEnd(r):
+		// A directive without arguments.
+		lx.backup()
+		lx.emitEmpty(itemArgsStart)
+		lx.emitEmpty(itemArgsEnd)
+		return lx.pop()
 	case isWhitespace(r) || isNL(r):
 		return lexSkip(lx, lexKeyEnd)
+	case lx.atBlockComment(r):
+		lx.next()
+		lx.push(lexKeyEnd)
+		return lexBlockCommentStart
+	case lx.isOperator(lx.input[lx.pos-lx.width:]):
+		lx.next()
+		lx.emit(itemOperator)
+		return lexValue
 	case isKeySeparator(r):
+		if !lx.dialect.allowsSeparator(r) {
+			return lx.errorf("The key separator '%v' is not allowed.", r)
+		}
 		return lexSkip(lx, lexValue)
+	case !lx.dialect.allowsSeparator(r):
+		return lx.errorf("Expected a key separator, but got '%v' instead.", r)
+	case lx.isDirectiveAhead(r):
+		lx.backup()
+		lx.emitEmpty(itemArgsStart)
+		lx.push(lexArgsEnd)
+		return lexValue
 	}
 	// We start the value here
 	lx.backup()
@@ -363,15 +881,21 @@ func lexValue(lx *lexer) stateFn {
 	}
 
 	switch {
+	case lx.atBlockComment(r):
+		lx.next()
+		lx.push(lexValue)
+		return lexBlockCommentStart
+	case !lx.dialect.UnquotedStrings && strings.ContainsRune("'$(<", r):
+		return lx.errorf("Expected a double-quoted string, but got '%v' instead.", r)
 	case r == arrayStart:
-		lx.ignore()
-		lx.emit(itemArrayStart)
-		lx.isEnd = isEndArrayUnQuoted
+		lx.emitEmpty(itemArrayStart)
 		return lexArrayValue
 	case r == mapStart:
-		lx.ignore()
-		lx.emit(itemMapStart)
+		lx.emitEmpty(itemMapStart)
 		return lexMapKeyStart
+	case (r == sqStringStart || r == dqStringStart) && lx.isLabelAhead():
+		lx.backup()
+		return lexLabel
 	case r == sqStringStart: //  single quote:   '
 		lx.ignore() // ignore the " or '
 		return lexQuotedString
@@ -380,6 +904,12 @@ func lexValue(lx *lexer) stateFn {
 		return lexDubQuotedString
 	case r == '-':
 		return lexNumberStart
+	case r == '+' && (isDigitAhead(lx.input[lx.pos:]) || isSpecialFloat(lx.input[lx.pos:])):
+		return lexNumberStart
+	case r == variableStart:
+		return lexVariableStart
+	case r == heredocStart && isHeredocAhead(lx.input[lx.pos:]):
+		return lexHeredocStart
 	case r == blockStart:
 		lx.next()   // ignore the /n after {
 		lx.ignore() // Ignore the (
@@ -398,6 +928,119 @@ func lexValue(lx *lexer) stateFn {
 	//return lx.errorf("Expected value but found '%s' instead.", r)
 }
 
+// isLabelAhead returns true if the quoted string just started is the label
+// of a block, followed by a '{' or more labels, rather than a value. Labels
+// are separated by whitespace, so only dialects allowing that have them.
+func (lx *lexer) isLabelAhead() bool {
+	if lx.dialect.Separators&SeparatorSpace == 0 || lx.container() == itemArrayStart ||
+		lx.container() == itemArgsStart {
+		return false
+	}
+	s := lx.input[lx.pos-1:]
+	for len(s) > 0 && (s[0] == dqStringStart || s[0] == sqStringStart) {
+		i := 1
+		for i < len(s) && s[i] != s[0] && !isNL(rune(s[i])) {
+			if s[0] == dqStringStart && s[i] == '\\' {
+				i++
+			}
+			i++
+		}
+		if i >= len(s) || s[i] != s[0] {
+			return false
+		}
+		s = strings.TrimLeft(s[i+1:], " \t")
+		if strings.HasPrefix(s, string(mapStart)) {
+			return true
+		}
+	}
+	return false
+}
+
+// lexLabel consumes the labels of a block, `"s3" "primary"`, and then goes
+// on to lexValue for the block itself. The labels are used exactly as
+// written, like quoted keys.
+func lexLabel(lx *lexer) stateFn {
+	r := lx.next()
+	switch {
+	case isWhitespace(r):
+		return lexSkip(lx, lexLabel)
+	case r == mapStart:
+		lx.backup()
+		return lexValue
+	}
+	quote := r
+	lx.ignore()
+	for r = lx.next(); r != quote; r = lx.next() {
+		if r == '\\' && quote == dqStringStart {
+			lx.next()
+		}
+	}
+	lx.backup()
+	lx.emit(itemLabel)
+	lx.next()
+	return lexSkip(lx, lexLabel)
+}
+
+// isDirectiveAhead returns true if r, just consumed after a key and the
+// whitespace following it, starts the arguments of a directive, rather than
+// a block, array or labeled block.
+func (lx *lexer) isDirectiveAhead(r rune) bool {
+	if !lx.dialect.Directives || r == mapStart || r == arrayStart {
+		return false
+	}
+	return !((r == sqStringStart || r == dqStringStart) && lx.isLabelAhead())
+}
+
+// isArgsEnd returns true if r, just consumed, ends the arguments of a
+// directive: a new line, ';', comment or the end of the input, or within a
+// hash, a ',' or '}'.
+func (lx *lexer) isArgsEnd(r rune) bool {
+	switch {
+	case isNL(r) || r == eof || r == optValTerm || r == commentHashStart:
+		return true
+	case r == commentSlashStart:
+		return strings.HasPrefix(lx.input[lx.pos:], string(commentSlashStart))
+	case r == mapEnd || r == mapValTerm:
+		c := lx.containers
+		if len(c) > 0 && c[len(c)-1] == itemArgsStart {
+			c = c[:len(c)-1]
+		}
+		return len(c) > 0 && c[len(c)-1] == itemMapStart
+	}
+	return false
+}
+
+// isDirectiveEnd returns true if r is the ';' that can end a directive
+// without arguments straight after its key.
+func (lx *lexer) isDirectiveEnd(r rune) bool {
+	return lx.dialect.Directives && r == optValTerm
+}
+
+// lexArgsEnd consumes the whitespace after an argument of a directive, and
+// then either the next argument, or the end of the directive, which is left
+// for the state that was on the stack when the arguments started.
+func lexArgsEnd(lx *lexer) stateFn {
+	r := lx.next()
+	switch {
+	case isWhitespace(r):
+		return lexSkip(lx, lexArgsEnd)
+	case lx.atBlockComment(r):
+		lx.next()
+		lx.push(lexArgsEnd)
+		return lexBlockCommentStart
+	case lx.isArgsEnd(r):
+		lx.backup()
+		lx.emitEmpty(itemArgsEnd)
+		return lx.pop()
+	case r == arrayEnd || r == arrayValTerm || r == mapEnd || r == mapValTerm:
+		return lx.errorf("Expected an argument or the end of a directive, "+
+			"but got '%v' instead.", r)
+	}
+	lx.backup()
+	lx.push(lexArgsEnd)
+	return lexValue
+}
+
 // lexArrayValue consumes one value in an array. It assumes that '[' or ','
 // have already been consumed. All whitespace and new lines are ignored.
 func lexArrayValue(lx *lexer) stateFn {
@@ -415,6 +1058,10 @@ func lexArrayValue(lx *lexer) stateFn {
 			lx.push(lexArrayValue)
 			return lexCommentStart
 		}
+		if rn == commentBlockStar {
+			lx.push(lexArrayValue)
+			return lexBlockCommentStart
+		}
 		lx.backup()
 		fallthrough
 	case r == arrayValTerm: //   ,  we should not have found comma yet
@@ -445,6 +1092,10 @@ func lexArrayValueEnd(lx *lexer) stateFn {
 			lx.push(lexArrayValueEnd)
 			return lexCommentStart
 		}
+		if rn == commentBlockStar {
+			lx.push(lexArrayValueEnd)
+			return lexBlockCommentStart
+		}
 		lx.backup()
 		fallthrough
 	case r == arrayValTerm || isNL(r):
@@ -461,7 +1112,6 @@ func lexArrayValueEnd(lx *lexer) stateFn {
 func lexArrayEnd(lx *lexer) stateFn {
 	lx.ignore()
 	lx.emit(itemArrayEnd)
-	lx.isEnd = isEndNormal
 	return lx.pop()
 }
 
@@ -474,6 +1124,7 @@ func lexMapKeyStart(lx *lexer) stateFn {
 	case r == eof:
 		return lx.errorf("Un terminated map")
 	case isKeySeparator(r):
+		lx.next()
 		return lx.errorf("Unexpected key separator '%v'.", r)
 	case isWhitespace(r) || isNL(r):
 		lx.next()
@@ -492,6 +1143,10 @@ func lexMapKeyStart(lx *lexer) stateFn {
 			lx.push(lexMapKeyStart)
 			return lexCommentStart
 		}
+		if rn == commentBlockStar {
+			lx.push(lexMapKeyStart)
+			return lexBlockCommentStart
+		}
 		lx.backup()
 	case r == sqStringStart:
 		lx.next()
@@ -499,6 +1154,14 @@ func lexMapKeyStart(lx *lexer) stateFn {
 	case r == dqStringStart:
 		lx.next()
 		return lexSkip(lx, lexMapDubQuotedKey)
+	case r == keyUnset && lx.dialect.Operators:
+		lx.next()
+		lx.emit(itemUnset)
+		lx.push(lexMapValueEnd)
+		return lexUnsetKey
+	case !lx.dialect.UnquotedKeys:
+		lx.next()
+		return lx.errorf("Expected a quoted key, but got '%v' instead.", r)
 	}
 	lx.ignore()
 	lx.next()
@@ -508,8 +1171,11 @@ func lexMapKeyStart(lx *lexer) stateFn {
 // lexMapQuotedKey consumes the text of a key between quotes.
 func lexMapQuotedKey(lx *lexer) stateFn {
 	r := lx.peek()
+	if r == eof {
+		return lx.errorf("Unexpected EOF in quoted key.")
+	}
 	if r == sqStringEnd {
-		lx.emit(itemKey)
+		lx.emit(itemQuotedKey)
 		lx.next()
 		return lexSkip(lx, lexMapKeyEnd)
 	}
@@ -520,8 +1186,11 @@ func lexMapQuotedKey(lx *lexer) stateFn {
 // lexMapQuotedKey consumes the text of a key between quotes.
 func lexMapDubQuotedKey(lx *lexer) stateFn {
 	r := lx.peek()
+	if r == eof {
+		return lx.errorf("Unexpected EOF in quoted key.")
+	}
 	if r == dqStringEnd {
-		lx.emit(itemKey)
+		lx.emit(itemQuotedKey)
 		lx.next()
 		return lexSkip(lx, lexMapKeyEnd)
 	}
@@ -533,8 +1202,18 @@ func lexMapDubQuotedKey(lx *lexer) stateFn {
 // is not whitespace) has already been consumed.
 func lexMapKey(lx *lexer) stateFn {
 	r := lx.peek()
-	if isWhitespace(r) || isNL(r) || isKeySeparator(r) {
-		lx.emit(itemKey)
+	if r == eof {
+		return lx.errorf("Un terminated map")
+	}
+	if isWhitespace(r) || isNL(r) || isKeySeparator(r) || lx.isDirectiveEnd(r) ||
+		lx.isOperator(lx.input[lx.pos:]) {
+		switch lx.emitKey() {
+		case itemInclude:
+			return lexMapValue
+		case itemUnset:
+			lx.push(lexMapValueEnd)
+			return lexUnsetKey
+		}
 		return lexMapKeyEnd
 	}
 	lx.next()
@@ -547,10 +1226,35 @@ func lexMapKey(lx *lexer) stateFn {
 func lexMapKeyEnd(lx *lexer) stateFn {
 	r := lx.next()
 	switch {
+	case lx.dialect.Directives && lx.isArgsEnd(r):
+		// A directive without arguments.
+		lx.backup()
+		lx.emitEmpty(itemArgsStart)
+		lx.emitEmpty(itemArgsEnd)
+		return lexMapValueEnd
 	case isWhitespace(r) || isNL(r):
 		return lexSkip(lx, lexMapKeyEnd)
+	case lx.atBlockComment(r):
+		lx.next()
+		lx.push(lexMapKeyEnd)
+		return lexBlockCommentStart
+	case lx.isOperator(lx.input[lx.pos-lx.width:]):
+		lx.next()
+		lx.emit(itemOperator)
+		return lexMapValue
 	case isKeySeparator(r):
+		if !lx.dialect.allowsSeparator(r) {
+			return lx.errorf("The key separator '%v' is not allowed.", r)
+		}
 		return lexSkip(lx, lexMapValue)
+	case !lx.dialect.allowsSeparator(r):
+		return lx.errorf("Expected a key separator, but got '%v' instead.", r)
+	case lx.isDirectiveAhead(r):
+		lx.backup()
+		lx.emitEmpty(itemArgsStart)
+		lx.push(lexMapValueEnd)
+		lx.push(lexArgsEnd)
+		return lexValue
 	}
 	// We start the value here
 	lx.backup()
@@ -574,6 +1278,10 @@ func lexMapValue(lx *lexer) stateFn {
 			lx.push(lexMapValue)
 			return lexCommentStart
 		}
+		if rn == commentBlockStar {
+			lx.push(lexMapValue)
+			return lexBlockCommentStart
+		}
 		lx.backup()
 		fallthrough
 	case r == mapValTerm:
@@ -602,6 +1310,10 @@ func lexMapValueEnd(lx *lexer) stateFn {
 			lx.push(lexMapValueEnd)
 			return lexCommentStart
 		}
+		if rn == commentBlockStar {
+			lx.push(lexMapValueEnd)
+			return lexBlockCommentStart
+		}
 		lx.backup()
 		fallthrough
 	case r == optValTerm || r == mapValTerm || isNL(r):
@@ -628,15 +1340,33 @@ func (lx *lexer) isBool() bool {
 	return str == "true" || str == "false"
 }
 
+// isNull returns true if the unquoted string just read is `null`, or its
+// alias `nil`.
+func (lx *lexer) isNull() bool {
+	str := lx.input[lx.start:lx.pos]
+	return str == "null" || str == "nil"
+}
+
+// isSpecialFloat returns true if s starts with infinity or not-a-number,
+// `inf` or `nan`, on its own.
+func isSpecialFloat(s string) bool {
+	if !strings.HasPrefix(s, "inf") && !strings.HasPrefix(s, "nan") {
+		return false
+	}
+	return len(s) == 3 || !isIdentifierRune(rune(s[3]), "_.")
+}
+
 // lexQuotedString consumes the inner contents of a string. It assumes that the
 // beginning '"' has already been consumed and ignored. It will not interpret any
 // internal contents.
 func lexQuotedString(lx *lexer) stateFn {
 	r := lx.next()
 	switch {
+	case r == eof:
+		return lx.errorf("Unexpected EOF in quoted string.")
 	case r == sqStringEnd:
 		lx.backup()
-		lx.emit(itemString)
+		lx.emit(itemRawString)
 		lx.next()
 		lx.ignore()
 		return lx.pop()
@@ -645,14 +1375,18 @@ func lexQuotedString(lx *lexer) stateFn {
 }
 
 // lexDubQuotedString consumes the inner contents of a string. It assumes that the
-// beginning '"' has already been consumed and ignored. It will not interpret any
-// internal contents.
+// beginning '"' has already been consumed and ignored. Escapes are checked
+// here, but are only interpreted by the parser.
 func lexDubQuotedString(lx *lexer) stateFn {
 	r := lx.next()
 	switch {
+	case r == '\\':
+		return lexDubQuotedStringEscape
+	case r == eof:
+		return lx.errorf("Unexpected EOF in quoted string.")
 	case r == dqStringEnd:
 		lx.backup()
-		lx.emit(itemString)
+		lx.emit(itemQuotedString)
 		lx.next()
 		lx.ignore()
 		return lx.pop()
@@ -671,14 +1405,25 @@ func lexString(lx *lexer) stateFn {
 	// Termination of non-quoted strings
 	case lx.isEnd(lx, r):
 		lx.backup()
-		if lx.isBool() {
+		if str := lx.input[lx.start:lx.pos]; lx.isBool() {
 			lx.emit(itemBool)
+		} else if lx.isNull() {
+			lx.emit(itemNull)
+		} else if len(str) == 3 && isSpecialFloat(str) {
+			lx.emit(itemFloat)
+		} else if !lx.dialect.UnquotedStrings {
+			return lx.errorAt(lx.start, "Expected a double-quoted string, "+
+				"but got '%s' instead.", str)
 		} else {
 			lx.emit(itemString)
 		}
 		return lx.pop()
 	case r == sqStringEnd:
 		lx.backup()
+		if !lx.dialect.UnquotedStrings {
+			return lx.errorAt(lx.start, "Expected a double-quoted string, "+
+				"but got '%s' instead.", lx.input[lx.start:lx.pos])
+		}
 		lx.emit(itemString)
 		lx.next()
 		lx.ignore()
@@ -699,6 +1444,8 @@ func lexDubString(lx *lexer) stateFn {
 		lx.backup()
 		if lx.isBool() {
 			lx.emit(itemBool)
+		} else if lx.isNull() {
+			lx.emit(itemNull)
 		} else {
 			lx.emit(itemString)
 		}
@@ -713,6 +1460,44 @@ func lexDubString(lx *lexer) stateFn {
 	return lexDubString
 }
 
+// lexVariableStart consumes a reference to another key, `$name` or
+// `${path.to.key}`. It assumes that the '$' has already been consumed. A '$'
+// that isn't followed by a name is just the start of a string.
+func lexVariableStart(lx *lexer) stateFn {
+	r := lx.peek()
+	switch {
+	case r == mapStart:
+		lx.next()
+		return lexBracedVariable
+	case lx.isIdentifierRune(r):
+		return lexVariable
+	}
+	return lexString
+}
+
+// lexVariable consumes the name of a variable after the '$'.
+func lexVariable(lx *lexer) stateFn {
+	if lx.isIdentifierRune(lx.peek()) {
+		lx.next()
+		return lexVariable
+	}
+	lx.emit(itemVariable)
+	return lx.pop()
+}
+
+// lexBracedVariable consumes the name of a variable between '${' and '}'.
+func lexBracedVariable(lx *lexer) stateFn {
+	r := lx.next()
+	switch {
+	case r == mapEnd:
+		lx.emit(itemVariable)
+		return lx.pop()
+	case r == eof || isNL(r):
+		return lx.errorf("Unterminated variable reference, expected '%v'.", mapEnd)
+	}
+	return lexBracedVariable
+}
+
 // lexBlock consumes the inner contents as a string. It assumes that the
 // beginning '(' has already been consumed and ignored. It will continue
 // processing until it finds a ')' on a new line by itself.
@@ -722,84 +1507,170 @@ func lexBlock(lx *lexer) stateFn {
 	//u.Debugf("lexBlock() pos=%d len=%d  %q", lx.pos, len(lx.input), lx.input[lx.pos:])
 
 	switch {
+	case r == eof:
+		return lx.errorf("Unexpected EOF in block, expected '%v' on a "+
+			"line by itself.", blockEnd)
 	case r == blockEnd:
-
-		lx.backup() // unconsume )  we are going to verify below
-		lx.backup() // unconsume previous rune to ensure it is newline
-
 		// Looking for a ')' character on a line by itself, if the previous
 		// character isn't a new line, then break so we keep processing the block.
-		if lx.next() != '\n' {
-			lx.next() // if inline ( this will consume it
+		end := lx.pos - lx.width
+		if end == 0 || lx.input[end-1] != '\n' {
 			break
 		}
-		lx.next()
 
 		// Make sure the next character is a new line or an eof. We want a ')' on a
 		// bare line by itself.
-		switch r = lx.next(); r {
-		case '\n', eof:
+		if r = lx.peek(); r != '\n' && r != eof {
+			break
+		}
+
+		// The block is everything up to the new line before the ')', which
+		// may be nothing at all for an empty block.
+		pos := lx.pos
+		lx.pos = end - 1
+		if lx.pos < lx.start {
+			lx.pos = lx.start
+		}
+		lx.line--
+		lx.emit(itemBlockString)
+		lx.line++
+		lx.pos = pos
+		lx.ignore()
+		return lx.pop()
+	}
+	return lexBlock
+}
+
+// isHeredocAhead returns true if s, following a '<', starts a heredoc, which
+// is another '<', an optional '-' and the start of a terminator.
+func isHeredocAhead(s string) bool {
+	if !strings.HasPrefix(s, string(heredocStart)) {
+		return false
+	}
+	s = strings.TrimPrefix(s[1:], string(heredocIndent))
+	return len(s) > 0 && isHeredocTerminatorStart(s[0])
+}
+
+func isHeredocTerminatorStart(c byte) bool {
+	return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+func isHeredocTerminatorChar(c byte) bool {
+	return isHeredocTerminatorStart(c) || ('0' <= c && c <= '9')
+}
+
+// lexHeredocStart consumes the start of a heredoc, `<<EOD` or `<<-EOD`, and
+// the new line after it. It assumes that the first '<' has already been
+// consumed. The heredoc runs until its terminator is on a line by itself,
+// which for `<<-` may be indented, and is emitted as it is written, without
+// escapes or references.
+func lexHeredocStart(lx *lexer) stateFn {
+	open := lx.pos - 1
+	lx.next()
+	typ := itemHeredoc
+	if strings.HasPrefix(lx.input[lx.pos:], string(heredocIndent)) {
+		lx.next()
+		typ = itemIndentedHeredoc
+	}
+	nameStart := lx.pos
+	for lx.pos < len(lx.input) && isHeredocTerminatorChar(lx.input[lx.pos]) {
+		lx.next()
+	}
+	terminator := lx.input[nameStart:lx.pos]
+	r := lx.next()
+	if r == '\r' {
+		r = lx.next()
+	}
+	if r != '\n' {
+		return lx.errorf("Expected a new line after the heredoc terminator '%s', "+
+			"but got '%v' instead.", terminator, r)
+	}
+	lx.ignore()
+
+	var lexHeredoc stateFn
+	lexHeredoc = func(lx *lexer) stateFn {
+		// Each time around consumes a whole line.
+		lineStart := lx.pos
+		r := lx.next()
+		for r != '\n' && r != eof {
+			r = lx.next()
+		}
+		line := strings.TrimSuffix(strings.TrimSuffix(lx.input[lineStart:lx.pos], "\n"), "\r")
+		if typ == itemIndentedHeredoc {
+			line = strings.TrimLeft(line, " \t")
+		}
+		if line != terminator {
 			if r == eof {
-				lx.width = 1
+				return lx.errorAt(open, "Unterminated heredoc, expected '%s' on a "+
+					"line by itself.", terminator)
 			}
-			lx.backup() // unconsume the \n, or eof
-			r = lx.peek()
-			if r != ')' { // For some reason on EOF we aren't where we think
-				lx.backup() // unconsume the )
+			return lexHeredoc
+		}
+		if r == '\n' {
+			// Leave the new line after the terminator to end the value.
+			lx.backup()
+		}
+
+		// The heredoc is everything up to the new line before the
+		// terminator, which may be nothing at all for an empty heredoc.
+		pos := lx.pos
+		lx.pos = lineStart
+		if lx.pos > lx.start {
+			lx.pos--
+			if lx.pos > lx.start && lx.input[lx.pos-1] == '\r' {
+				lx.pos--
 			}
-			lx.backup() // unconsume the \n
-			lx.emit(itemString)
-			lx.next() // consume the previous line \n
-			lx.next() // consume the )
-			lx.ignore()
-			return lx.pop()
 		}
-		lx.backup()
+		lx.line--
+		lx.emit(typ)
+		lx.line++
+		lx.pos = pos
+		lx.ignore()
+		return lx.pop()
 	}
-	return lexBlock
+	return lexHeredoc
 }
 
-// lexStringEscape consumes an escaped character. It assumes that the preceding
-// '\\' has already been consumed.
+// lexStringEscape consumes an escaped character in an unquoted string. It
+// assumes that the preceding '\\' has already been consumed.
 func lexStringEscape(lx *lexer) stateFn {
-	r := lx.next()
-	switch r {
-	case 'x':
-		return lexStringBinary
-	case 't':
-		fallthrough
-	case 'n':
-		fallthrough
-	case 'r':
-		fallthrough
-	case '"':
-		fallthrough
-	case '\\':
-		return lexString
-	}
-	return lx.errorf("Invalid escape character '%v'. Only the following "+
-		"escape characters are allowed: \\xXX, \\t, \\n, \\r, \\\", \\\\.", r)
+	return lx.escape(lexString)
 }
 
-// lexStringBinary consumes two hexadecimal digits following '\x'. It assumes
-// that the '\x' has already been consumed.
-func lexStringBinary(lx *lexer) stateFn {
+// lexDubQuotedStringEscape consumes an escaped character in a double quoted
+// string. It assumes that the preceding '\\' has already been consumed.
+func lexDubQuotedStringEscape(lx *lexer) stateFn {
+	return lx.escape(lexDubQuotedString)
+}
+
+// escape consumes the rest of an escape sequence after its '\\', which are
+// those of JSON, along with '\xXX', and moves on to the next state.
+func (lx *lexer) escape(next stateFn) stateFn {
 	r := lx.next()
-	if !isHexadecimal(r) {
-		return lx.errorf("Expected two hexadecimal digits after '\\x', but "+
-			"got '%v' instead.", r)
+	digits := 0
+	switch r {
+	case 'b', 't', 'n', 'f', 'r', '"', '/', '\\':
+		return next
+	case 'x':
+		digits = 2
+	case 'u':
+		digits = 4
+	default:
+		return lx.errorf("Invalid escape character '%v'. Only the following "+
+			"escape characters are allowed: \\b, \\t, \\n, \\f, \\r, \\\", \\/, "+
+			"\\\\, \\xXX and \\uXXXX.", r)
 	}
-
-	r = lx.next()
-	if !isHexadecimal(r) {
-		return lx.errorf("Expected two hexadecimal digits after '\\x', but "+
-			"got '%v' instead.", r)
+	for i := 0; i < digits; i++ {
+		if d := lx.next(); !isHexadecimal(d) {
+			return lx.errorf("Expected %d hexadecimal digits after '\\%v', but "+
+				"got '%v' instead.", digits, r, d)
+		}
 	}
-	return lexString
+	return next
 }
 
-// lexNumberOrDateStart consumes either a (positive) integer, float or datetime.
-// It assumes that NO negative sign has been consumed.
+// lexNumberOrDateStart consumes either a (positive) integer, float, datetime,
+// date or time of day. It assumes that NO negative sign has been consumed.
 func lexNumberOrDateStart(lx *lexer) stateFn {
 	r := lx.next()
 	if !isDigit(r) {
@@ -809,22 +1680,39 @@ func lexNumberOrDateStart(lx *lexer) stateFn {
 			return lx.errorf("Expected a digit but got '%v'.", r)
 		}
 	}
+	if r == '0' && isBasePrefix(lx.peek()) {
+		return lexBasePrefix
+	}
 	return lexNumberOrDate
 }
 
-// lexNumberOrDate consumes either a (positive) integer, float or datetime.
+// lexNumberOrDate consumes either a (positive) integer, float, datetime, date
+// or time of day.
 func lexNumberOrDate(lx *lexer) stateFn {
 	r := lx.next()
 	switch {
 	case r == '-':
 		if lx.pos-lx.start != 5 {
-			return lx.errorf("All ISO8601 dates must be in full Zulu form.")
+			return lx.errorf("Dates must be in RFC 3339 form, e.g. 2006-01-02.")
 		}
 		return lexDateAfterYear
+	case r == ':':
+		if lx.pos-lx.start != 3 {
+			return lx.errorf("Times must be in RFC 3339 form, e.g. 15:04:05.")
+		}
+		return lexTimeAfterHour
 	case isDigit(r):
 		return lexNumberOrDate
+	case r == '_':
+		return lx.digitSeparator(lexNumber, isDigit)
 	case r == '.':
 		return lexFloatStart
+	case r == 'e' || r == 'E':
+		return lexExponentStart
+	case sizeSuffixLen(lx.input[lx.pos-lx.width:]) > 0:
+		return lexSizeSuffix
+	case isDurationUnit(r):
+		return lexDuration
 	}
 
 	lx.backup()
@@ -832,37 +1720,107 @@ func lexNumberOrDate(lx *lexer) stateFn {
 	return lx.pop()
 }
 
-// lexDateAfterYear consumes a full Zulu Datetime in ISO8601 format.
-// It assumes that "YYYY-" has already been consumed.
+// lexDateAfterYear consumes a date, and the time and offset following it for
+// a datetime, in RFC 3339 form. It assumes that "YYYY-" has already been
+// consumed. The 'T' between the date and time may also be a 't' or a space.
 func lexDateAfterYear(lx *lexer) stateFn {
-	formats := []rune{
-		// digits are '0'.
-		// everything else is direct equality.
-		'0', '0', '-', '0', '0',
-		'T',
-		'0', '0', ':', '0', '0', ':', '0', '0',
-		'Z',
-	}
-	for _, f := range formats {
+	if state := lx.acceptFormat("date", "00-00"); state != nil {
+		return state
+	}
+	switch r := lx.peek(); {
+	case r == 'T' || r == 't':
+	case r == ' ' && isTimeAhead(lx.input[lx.pos+1:]):
+	default:
+		lx.emit(itemDate)
+		return lx.pop()
+	}
+	lx.next()
+	if state := lx.acceptFormat("datetime", "00:00:00"); state != nil {
+		return state
+	}
+	if state := lx.acceptFraction(); state != nil {
+		return state
+	}
+	switch r := lx.next(); r {
+	case 'Z', 'z':
+	case '+', '-':
+		if state := lx.acceptFormat("datetime offset", "00:00"); state != nil {
+			return state
+		}
+	default:
+		return lx.errorf("Expected 'Z' or an offset like '+02:00' in datetime, "+
+			"but found '%v' instead.", r)
+	}
+	lx.emit(itemDatetime)
+	return lx.pop()
+}
+
+// lexTimeAfterHour consumes a time of day in RFC 3339 form, without an
+// offset. It assumes that "HH:" has already been consumed.
+func lexTimeAfterHour(lx *lexer) stateFn {
+	if state := lx.acceptFormat("time", "00:00"); state != nil {
+		return state
+	}
+	if state := lx.acceptFraction(); state != nil {
+		return state
+	}
+	lx.emit(itemTime)
+	return lx.pop()
+}
+
+// acceptFormat consumes input in the given format, where each '0' is a digit
+// and anything else must be matched exactly. It returns an error state if
+// the input doesn't match, or nil if it does.
+func (lx *lexer) acceptFormat(what, format string) stateFn {
+	for _, f := range format {
 		r := lx.next()
 		if f == '0' {
 			if !isDigit(r) {
-				return lx.errorf("Expected digit in ISO8601 datetime, "+
-					"but found '%v' instead.", r)
+				return lx.errorf("Expected digit in %s, but found '%v' instead.", what, r)
 			}
 		} else if f != r {
-			return lx.errorf("Expected '%v' in ISO8601 datetime, "+
-				"but found '%v' instead.", f, r)
+			return lx.errorf("Expected '%v' in %s, but found '%v' instead.", f, what, r)
 		}
 	}
-	lx.emit(itemDatetime)
-	return lx.pop()
+	return nil
+}
+
+// acceptFraction consumes the optional fraction of a second after a time,
+// returning an error state if it has no digits.
+func (lx *lexer) acceptFraction() stateFn {
+	if lx.peek() != '.' {
+		return nil
+	}
+	lx.next()
+	if !isDigit(lx.peek()) {
+		return lx.errorf("Expected digit in fraction of a second, but found '%v' instead.", lx.next())
+	}
+	for isDigit(lx.peek()) {
+		lx.next()
+	}
+	return nil
+}
+
+// isDigitAhead returns true if s starts with a digit. Unlike peek, it
+// leaves the width of the last rune read alone, so it can still be backed up.
+func isDigitAhead(s string) bool {
+	return len(s) > 0 && isDigit(rune(s[0]))
+}
+
+// isTimeAhead returns true if s starts with a time, "HH:".
+func isTimeAhead(s string) bool {
+	return len(s) >= 3 && isDigit(rune(s[0])) && isDigit(rune(s[1])) && s[2] == ':'
 }
 
 // lexNumberStart consumes either an integer or a float. It assumes that a
-// negative sign has already been read, but that *no* digits have been consumed.
+// sign has already been read, but that *no* digits have been consumed.
 // lexNumberStart will move to the appropriate integer or float states.
 func lexNumberStart(lx *lexer) stateFn {
+	if isSpecialFloat(lx.input[lx.pos:]) {
+		lx.pos += 3
+		lx.emit(itemFloat)
+		return lx.pop()
+	}
 	// we MUST see a digit. Even floats have to start with a digit.
 	r := lx.next()
 	if !isDigit(r) {
@@ -872,17 +1830,66 @@ func lexNumberStart(lx *lexer) stateFn {
 			return lx.errorf("Expected a digit but got '%v'.", r)
 		}
 	}
+	if r == '0' && isBasePrefix(lx.peek()) {
+		return lexBasePrefix
+	}
 	return lexNumber
 }
 
+// lexBasePrefix consumes the 'x', 'o' or 'b' after the '0' of a hexadecimal,
+// octal or binary integer, and moves on to its digits.
+func lexBasePrefix(lx *lexer) stateFn {
+	isBaseDigit := isHexadecimal
+	switch lx.next() {
+	case 'o', 'O':
+		isBaseDigit = isOctal
+	case 'b', 'B':
+		isBaseDigit = isBinary
+	}
+	if r := lx.next(); !isBaseDigit(r) {
+		return lx.errorf("Expected a digit after the base prefix, but got '%v'.", r)
+	}
+	var lexDigits stateFn
+	lexDigits = func(lx *lexer) stateFn {
+		r := lx.next()
+		switch {
+		case isBaseDigit(r):
+			return lexDigits
+		case r == '_':
+			return lx.digitSeparator(lexDigits, isBaseDigit)
+		}
+		lx.backup()
+		lx.emit(itemInteger)
+		return lx.pop()
+	}
+	return lexDigits
+}
+
+// digitSeparator checks that the '_' just consumed is followed by a digit,
+// as it was preceded by one, and moves on to the next state.
+func (lx *lexer) digitSeparator(next stateFn, isDigit func(rune) bool) stateFn {
+	if !isDigit(lx.peek()) {
+		return lx.errorf("Underscores in numbers must be between digits.")
+	}
+	return next
+}
+
 // lexNumber consumes an integer or a float after seeing the first digit.
 func lexNumber(lx *lexer) stateFn {
 	r := lx.next()
 	switch {
 	case isDigit(r):
 		return lexNumber
+	case r == '_':
+		return lx.digitSeparator(lexNumber, isDigit)
 	case r == '.':
 		return lexFloatStart
+	case r == 'e' || r == 'E':
+		return lexExponentStart
+	case sizeSuffixLen(lx.input[lx.pos-lx.width:]) > 0:
+		return lexSizeSuffix
+	case isDurationUnit(r):
+		return lexDuration
 	}
 
 	lx.backup()
@@ -905,8 +1912,15 @@ func lexFloatStart(lx *lexer) stateFn {
 // Assumes that one digit has been consumed after a '.' already.
 func lexFloat(lx *lexer) stateFn {
 	r := lx.next()
-	if isDigit(r) {
+	switch {
+	case isDigit(r):
 		return lexFloat
+	case r == '_':
+		return lx.digitSeparator(lexFloat, isDigit)
+	case r == 'e' || r == 'E':
+		return lexExponentStart
+	case isDurationUnit(r):
+		return lexDuration
 	}
 
 	lx.backup()
@@ -914,9 +1928,68 @@ func lexFloat(lx *lexer) stateFn {
 	return lx.pop()
 }
 
+// lexSizeSuffix consumes the rest of the size suffix of an integer, such
+// as `64MB`, after its first letter.
+func lexSizeSuffix(lx *lexer) stateFn {
+	for n := sizeSuffixLen(lx.input[lx.pos-lx.width:]); n > 1; n-- {
+		lx.next()
+	}
+	lx.emit(itemInteger)
+	return lx.pop()
+}
+
+// lexExponentStart consumes the optional sign and the first digit of the
+// exponent of a float, after the 'e'.
+func lexExponentStart(lx *lexer) stateFn {
+	r := lx.next()
+	if r == '+' || r == '-' {
+		r = lx.next()
+	}
+	if !isDigit(r) {
+		return lx.errorf("Expected a digit in the exponent of a float, but "+
+			"got '%v' instead.", r)
+	}
+	return lexExponent
+}
+
+// lexExponent consumes the rest of the digits of the exponent of a float.
+func lexExponent(lx *lexer) stateFn {
+	r := lx.next()
+	switch {
+	case isDigit(r):
+		return lexExponent
+	case r == '_':
+		return lx.digitSeparator(lexExponent, isDigit)
+	}
+
+	lx.backup()
+	lx.emit(itemFloat)
+	return lx.pop()
+}
+
+// lexDuration consumes the rest of a duration, such as `1h30m` or `1.5s`,
+// after the unit of its first number. The parser checks that it is valid.
+func lexDuration(lx *lexer) stateFn {
+	r := lx.next()
+	if isDigit(r) || r == '.' || isDurationUnit(r) {
+		return lexDuration
+	}
+
+	lx.backup()
+	lx.emit(itemDuration)
+	return lx.pop()
+}
+
 // lexCommentStart begins the lexing of a comment. It will emit
 // itemCommentStart and consume no characters, passing control to lexComment.
 func lexCommentStart(lx *lexer) stateFn {
+	style, start := HashComments, "#"
+	if lx.input[lx.pos-1] != commentHashStart {
+		style, start = SlashComments, "//"
+	}
+	if lx.dialect.Comments&style == 0 {
+		return lx.errorAt(lx.pos-len(start), "Comments starting with '%s' are not allowed.", start)
+	}
 	lx.ignore()
 	lx.emit(itemCommentStart)
 	return lexComment
@@ -935,6 +2008,50 @@ func lexComment(lx *lexer) stateFn {
 	return lexComment
 }
 
+// lexBlockCommentStart begins the lexing of a block comment, after its '/*'
+// has been consumed. Like lexCommentStart, it emits itemCommentStart and
+// then the text of the comment, and passes control back to the last state
+// on the stack. Block comments may be nested.
+func lexBlockCommentStart(lx *lexer) stateFn {
+	open := lx.pos - 2
+	if lx.dialect.Comments&BlockComments == 0 {
+		return lx.errorAt(open, "Comments starting with '/*' are not allowed.")
+	}
+	lx.ignore()
+	lx.emit(itemCommentStart)
+	depth := 1
+	var lexBlockComment stateFn
+	lexBlockComment = func(lx *lexer) stateFn {
+		r := lx.next()
+		switch {
+		case r == eof:
+			return lx.errorAt(open, "Unterminated block comment, expected '*/'.")
+		case lx.atBlockComment(r):
+			lx.next()
+			depth++
+		case r == commentBlockStar && strings.HasPrefix(lx.input[lx.pos:], string(commentSlashStart)):
+			if depth--; depth > 0 {
+				lx.next()
+				break
+			}
+			lx.pos--
+			lx.emit(itemText)
+			lx.pos += 2
+			lx.ignore()
+			return lx.pop()
+		}
+		return lexBlockComment
+	}
+	return lexBlockComment
+}
+
+// atBlockComment returns true if r, just read, starts a block comment. Unlike
+// peek, it leaves the width of the last rune read alone, so it can still be
+// backed up.
+func (lx *lexer) atBlockComment(r rune) bool {
+	return r == commentSlashStart && strings.HasPrefix(lx.input[lx.pos:], string(commentBlockStar))
+}
+
 // lexSkip ignores all slurped input and moves on to the next state.
 func lexSkip(lx *lexer, nextState stateFn) stateFn {
 	return func(lx *lexer) stateFn {
@@ -951,11 +2068,19 @@ func isEndArrayUnQuoted(lx *lexer, r rune) bool {
 	return (isNL(r) || r == eof || r == optValTerm || r == arrayEnd || r == arrayValTerm || isWhitespace(r))
 }
 
-func isIdentifierRune(r rune) bool {
+func isEndMapUnQuoted(lx *lexer, r rune) bool {
+	return (isNL(r) || r == eof || r == optValTerm || r == mapEnd || r == mapValTerm || isWhitespace(r))
+}
+
+func (lx *lexer) isIdentifierRune(r rune) bool {
+	return isIdentifierRune(r, lx.dialect.IdentifierChars)
+}
+
+func isIdentifierRune(r rune, chars string) bool {
 	if unicode.IsLetter(r) || unicode.IsDigit(r) {
 		return true
 	}
-	for _, allowedRune := range IdentityChars {
+	for _, allowedRune := range chars {
 		if allowedRune == r {
 			return true
 		}
@@ -978,10 +2103,34 @@ func isNL(r rune) bool {
 	return r == '\n' || r == '\r'
 }
 
+// isDurationUnit returns true if `r` can start or be part of the unit of a
+// duration: ns, us, µs, ms, s, m or h.
+func isDurationUnit(r rune) bool {
+	switch r {
+	case 'n', 'u', 'µ', 'm', 's', 'h':
+		return true
+	}
+	return false
+}
+
 func isDigit(r rune) bool {
 	return r >= '0' && r <= '9'
 }
 
+func isOctal(r rune) bool {
+	return r >= '0' && r <= '7'
+}
+
+func isBinary(r rune) bool {
+	return r == '0' || r == '1'
+}
+
+// isBasePrefix returns true if `r` follows a '0' to start a hexadecimal,
+// octal or binary integer.
+func isBasePrefix(r rune) bool {
+	return strings.ContainsRune("xXoObB", r)
+}
+
 func isHexadecimal(r rune) bool {
 	return (r >= '0' && r <= '9') ||
 		(r >= 'a' && r <= 'f') ||
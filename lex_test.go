@@ -8,8 +8,16 @@ import (
 
 var _ = u.EMPTY
 
+// testItem is an item without its exact position, which is checked
+// separately by TestLexPositions.
+type testItem struct {
+	typ  itemType
+	val  string
+	line int
+}
+
 // Test to make sure we get what we expect.
-func expect(t *testing.T, lx *lexer, items []item) {
+func expect(t *testing.T, lx *lexer, items []testItem) {
 	for i := 0; i < len(items); i++ {
 		item := lx.nextItem()
 		if item.typ == itemEOF {
@@ -17,7 +25,7 @@ func expect(t *testing.T, lx *lexer, items []item) {
 		} else if item.typ == itemError {
 			t.Fatal(item.val)
 		}
-		if item != items[i] {
+		if (testItem{item.typ, item.val, item.line}) != items[i] {
 			//u.Debugf("\n\n%s wanted: \n%s\ngot: \n%s", label, wantStr, got)
 			wantStr := items[i].val
 			got := item.val
@@ -88,15 +96,16 @@ func TestLexBadConfString(t *testing.T) {
 }
 
 func TestLexSimpleKeyStringValues(t *testing.T) {
-	expectedItems := []item{
+	expectedItems := []testItem{
 		{itemKey, "foo", 1},
-		{itemString, "bar", 1},
+		{itemQuotedString, "bar", 1},
 		{itemEOF, "", 1},
 	}
 	// Double quotes
 	lx := lex("foo = \"bar\"")
 	expect(t, lx, expectedItems)
-	// Single quotes
+	// Single quotes are raw strings
+	expectedItems[1].typ = itemRawString
 	lx = lex("foo = 'bar'")
 	expect(t, lx, expectedItems)
 	// No spaces
@@ -108,7 +117,7 @@ func TestLexSimpleKeyStringValues(t *testing.T) {
 }
 
 func TestLexSimpleKeyIntegerValues(t *testing.T) {
-	expectedItems := []item{
+	expectedItems := []testItem{
 		{itemKey, "foo", 1},
 		{itemInteger, "123", 1},
 		{itemEOF, "", 1},
@@ -122,7 +131,7 @@ func TestLexSimpleKeyIntegerValues(t *testing.T) {
 }
 
 func TestLexSimpleKeyFloatValues(t *testing.T) {
-	expectedItems := []item{
+	expectedItems := []testItem{
 		{itemKey, "foo", 1},
 		{itemFloat, "22.2", 1},
 		{itemEOF, "", 1},
@@ -136,7 +145,7 @@ func TestLexSimpleKeyFloatValues(t *testing.T) {
 }
 
 func TestLexSimpleKeyBoolValues(t *testing.T) {
-	expectedItems := []item{
+	expectedItems := []testItem{
 		{itemKey, "foo", 1},
 		{itemBool, "true", 1},
 		{itemEOF, "", 1},
@@ -148,7 +157,7 @@ func TestLexSimpleKeyBoolValues(t *testing.T) {
 	lx = lex("foo=true\r\n")
 	expect(t, lx, expectedItems)
 	lx = lex("foo=True")
-	expect(t, lx, []item{
+	expect(t, lx, []testItem{
 		{itemKey, "foo", 1},
 		{itemBool, "True", 1},
 		{itemEOF, "", 1},
@@ -156,7 +165,7 @@ func TestLexSimpleKeyBoolValues(t *testing.T) {
 }
 
 func TestLexComments(t *testing.T) {
-	expectedItems := []item{
+	expectedItems := []testItem{
 		{itemCommentStart, "", 1},
 		{itemText, " This is a comment", 1},
 		{itemEOF, "", 1},
@@ -170,13 +179,13 @@ func TestLexComments(t *testing.T) {
 }
 
 func TestLexArrays(t *testing.T) {
-	expectedItems := []item{
+	expectedItems := []testItem{
 		{itemKey, "foo", 1},
 		{itemArrayStart, "", 1},
 		{itemInteger, "1", 1},
 		{itemInteger, "2", 1},
 		{itemInteger, "3", 1},
-		{itemString, "bar", 1},
+		{itemRawString, "bar", 1},
 		{itemArrayEnd, "", 1},
 		{itemEOF, "", 1},
 	}
@@ -200,7 +209,7 @@ foo = [
 `
 
 func TestLexMultilineArrays(t *testing.T) {
-	expectedItems := []item{
+	expectedItems := []testItem{
 		{itemCommentStart, "", 2},
 		{itemText, " top level comment", 2},
 		{itemKey, "foo", 3},
@@ -214,8 +223,8 @@ func TestLexMultilineArrays(t *testing.T) {
 		{itemInteger, "3", 6},
 		{itemCommentStart, "", 6},
 		{itemText, " Three", 6},
-		{itemString, "bar", 7},
-		{itemString, "bar", 8},
+		{itemRawString, "bar", 7},
+		{itemQuotedString, "bar", 8},
 		{itemArrayEnd, "", 9},
 		{itemEOF, "", 9},
 	}
@@ -247,7 +256,7 @@ foo = [
 `
 
 func TestLexMultilineArraysNoSep(t *testing.T) {
-	expectedItems := []item{
+	expectedItems := []testItem{
 		{itemCommentStart, "", 2},
 		{itemText, " top level comment", 2},
 		{itemKey, "foo", 3},
@@ -255,8 +264,8 @@ func TestLexMultilineArraysNoSep(t *testing.T) {
 		{itemInteger, "1", 4},
 		{itemInteger, "2", 5},
 		{itemInteger, "3", 6},
-		{itemString, "bar", 7},
-		{itemString, "bar", 8},
+		{itemRawString, "bar", 7},
+		{itemQuotedString, "bar", 8},
 		{itemArrayEnd, "", 9},
 		{itemEOF, "", 9},
 	}
@@ -265,11 +274,11 @@ func TestLexMultilineArraysNoSep(t *testing.T) {
 }
 
 func TestLexSimpleMap(t *testing.T) {
-	expectedItems := []item{
+	expectedItems := []testItem{
 		{itemKey, "foo", 1},
 		{itemMapStart, "", 1},
 		{itemKey, "ip", 1},
-		{itemString, "127.0.0.1", 1},
+		{itemRawString, "127.0.0.1", 1},
 		{itemKey, "port", 1},
 		{itemInteger, "4242", 1},
 		{itemMapEnd, "", 1},
@@ -292,11 +301,11 @@ foo = {
 `
 
 func TestLexMultilineMap(t *testing.T) {
-	expectedItems := []item{
+	expectedItems := []testItem{
 		{itemKey, "foo", 2},
 		{itemMapStart, "", 2},
 		{itemKey, "ip", 3},
-		{itemString, "127.0.0.1", 3},
+		{itemRawString, "127.0.0.1", 3},
 		{itemCommentStart, "", 4},
 		{itemText, " comment1", 4},
 		{itemCommentStart, "", 5},
@@ -327,13 +336,13 @@ foo = {
 `
 
 func TestLexNestedMaps(t *testing.T) {
-	expectedItems := []item{
+	expectedItems := []testItem{
 		{itemKey, "foo", 2},
 		{itemMapStart, "", 2},
 		{itemKey, "host", 3},
 		{itemMapStart, "", 3},
 		{itemKey, "ip", 4},
-		{itemString, "127.0.0.1", 4},
+		{itemRawString, "127.0.0.1", 4},
 		{itemKey, "port", 5},
 		{itemInteger, "4242", 5},
 		{itemCommentStart, "", 6},
@@ -350,13 +359,15 @@ func TestLexNestedMaps(t *testing.T) {
 }
 
 func TestLexQuotedKeys(t *testing.T) {
-	expectedItems := []item{
+	expectedItems := []testItem{
 		{itemKey, "foo", 1},
 		{itemInteger, "123", 1},
 		{itemEOF, "", 1},
 	}
 	lx := lex("foo : 123")
 	expect(t, lx, expectedItems)
+	// Quoted keys are used exactly as written
+	expectedItems[0].typ = itemQuotedKey
 	lx = lex("'foo' : 123")
 	expect(t, lx, expectedItems)
 	lx = lex("\"foo\" : 123")
@@ -364,8 +375,8 @@ func TestLexQuotedKeys(t *testing.T) {
 }
 
 func TestLexQuotedKeysWithSpace(t *testing.T) {
-	expectedItems := []item{
-		{itemKey, " foo", 1},
+	expectedItems := []testItem{
+		{itemQuotedKey, " foo", 1},
 		{itemInteger, "123", 1},
 		{itemEOF, "", 1},
 	}
@@ -376,7 +387,7 @@ func TestLexQuotedKeysWithSpace(t *testing.T) {
 }
 
 func TestLexColonKeySep(t *testing.T) {
-	expectedItems := []item{
+	expectedItems := []testItem{
 		{itemKey, "foo", 1},
 		{itemInteger, "123", 1},
 		{itemEOF, "", 1},
@@ -392,7 +403,7 @@ func TestLexColonKeySep(t *testing.T) {
 }
 
 func TestLexWhitespaceKeySep(t *testing.T) {
-	expectedItems := []item{
+	expectedItems := []testItem{
 		{itemKey, "foo", 1},
 		{itemInteger, "123", 1},
 		{itemEOF, "", 1},
@@ -417,13 +428,13 @@ foo  {
 `
 
 func TestLexNestedWhitespaceMaps(t *testing.T) {
-	expectedItems := []item{
+	expectedItems := []testItem{
 		{itemKey, "foo", 2},
 		{itemMapStart, "", 2},
 		{itemKey, "host", 3},
 		{itemMapStart, "", 3},
 		{itemKey, "ip", 4},
-		{itemString, "127.0.0.1", 4},
+		{itemRawString, "127.0.0.1", 4},
 		{itemKey, "port", 5},
 		{itemInteger, "4242", 5},
 		{itemMapEnd, "", 6},
@@ -444,7 +455,7 @@ table  [
 `
 
 func TestLexTableOfArrays(t *testing.T) {
-	expectedItems := []item{
+	expectedItems := []testItem{
 		{itemKey, "table", 2},
 		{itemArrayStart, "", 2},
 		{itemArrayStart, "", 3},
@@ -452,8 +463,8 @@ func TestLexTableOfArrays(t *testing.T) {
 		{itemInteger, "2", 3},
 		{itemArrayEnd, "", 3},
 		{itemArrayStart, "", 4},
-		{itemString, "a", 4},
-		{itemString, "b", 4},
+		{itemQuotedString, "a", 4},
+		{itemQuotedString, "b", 4},
 		{itemArrayEnd, "", 4},
 		{itemArrayEnd, "", 5},
 		{itemEOF, "", 6},
@@ -473,13 +484,13 @@ map {
 `
 
 func TestOptionalSemicolons(t *testing.T) {
-	expectedItems := []item{
+	expectedItems := []testItem{
 		{itemKey, "foo", 2},
 		{itemInteger, "123", 2},
 		{itemKey, "bar", 3},
-		{itemString, "baz", 3},
+		{itemRawString, "baz", 3},
 		{itemKey, "baz", 4},
-		{itemString, "boo", 4},
+		{itemRawString, "boo", 4},
 		{itemKey, "map", 5},
 		{itemMapStart, "", 5},
 		{itemKey, "id", 6},
@@ -493,9 +504,9 @@ func TestOptionalSemicolons(t *testing.T) {
 }
 
 func TestLexSemicolonChaining(t *testing.T) {
-	expectedItems := []item{
+	expectedItems := []testItem{
 		{itemKey, "foo", 1},
-		{itemString, "1", 1},
+		{itemRawString, "1", 1},
 		{itemKey, "bar", 1},
 		{itemFloat, "2.2", 1},
 		{itemKey, "baz", 1},
@@ -523,7 +534,7 @@ fkey = five # This should be a string
 `
 
 func TestLexNonQuotedStrings(t *testing.T) {
-	expectedItems := []item{
+	expectedItems := []testItem{
 		{itemKey, "foo", 2},
 		{itemInteger, "123", 2},
 		{itemKey, "bar", 3},
@@ -542,7 +553,7 @@ func TestLexNonQuotedStrings(t *testing.T) {
 		{itemKey, "f", 10},
 		{itemBool, "false", 10},
 		{itemKey, "tstr", 11},
-		{itemString, "true", 11},
+		{itemQuotedString, "true", 11},
 		{itemKey, "tkey", 12},
 		{itemString, "two", 12},
 		{itemKey, "fkey", 13},
@@ -557,10 +568,10 @@ func TestLexNonQuotedStrings(t *testing.T) {
 }
 
 func TestLexMapQuotedKeys(t *testing.T) {
-	expectedItems := []item{
+	expectedItems := []testItem{
 		{itemKey, "foo", 1},
 		{itemMapStart, "", 1},
-		{itemKey, "bar", 1},
+		{itemQuotedKey, "bar", 1},
 		{itemInteger, "4242", 1},
 		{itemMapEnd, "", 1},
 		{itemEOF, "", 1},
@@ -572,10 +583,10 @@ func TestLexMapQuotedKeys(t *testing.T) {
 }
 
 func TestLexSpecialCharsMapQuotedKeys(t *testing.T) {
-	expectedItems := []item{
+	expectedItems := []testItem{
 		{itemKey, "foo", 1},
 		{itemMapStart, "", 1},
-		{itemKey, "bar-1.2.3", 1},
+		{itemQuotedKey, "bar-1.2.3", 1},
 		{itemMapStart, "", 1},
 		{itemKey, "port", 1},
 		{itemInteger, "4242", 1},
@@ -598,13 +609,13 @@ systems {
 `
 
 func TestLexDoubleNestedMapsNewLines(t *testing.T) {
-	expectedItems := []item{
+	expectedItems := []testItem{
 		{itemKey, "systems", 2},
 		{itemMapStart, "", 2},
 		{itemKey, "allinone", 3},
 		{itemMapStart, "", 3},
 		{itemKey, "description", 4},
-		{itemString, "This is a description.", 4},
+		{itemQuotedString, "This is a description.", 4},
 		{itemMapEnd, "", 5},
 		{itemMapEnd, "", 6},
 		{itemEOF, "", 7},
@@ -620,18 +631,18 @@ numbers (
 `
 
 func TestLexBlockString(t *testing.T) {
-	expectedItems := []item{
+	expectedItems := []testItem{
 		{itemKey, "numbers", 2},
-		{itemString, "1234567890", 3},
+		{itemBlockString, "1234567890", 3},
 	}
 	lx := lex(blockexample)
 	expect(t, lx, expectedItems)
 }
 
 func TestLexBlockStringEOF(t *testing.T) {
-	expectedItems := []item{
+	expectedItems := []testItem{
 		{itemKey, "numbers", 2},
-		{itemString, "1234567890", 3},
+		{itemBlockString, "1234567890", 3},
 	}
 	blockbytes := []byte(blockexample[0 : len(blockexample)-1])
 	blockbytes = append(blockbytes, 0)
@@ -654,10 +665,383 @@ var mlBlockTextVal = `  12(34)56
   )`
 
 func TestLexBlockStringMultiLine(t *testing.T) {
-	expectedItems := []item{
+	expectedItems := []testItem{
 		{itemKey, "numbers", 2},
-		{itemString, mlBlockTextVal, 6},
+		{itemBlockString, mlBlockTextVal, 6},
 	}
 	lx := lex(mlblockexample)
 	expect(t, lx, expectedItems)
 }
+
+var positionsExample = `
+name = "café"
+db {
+	port 5432
+}
+`
+
+func TestLexPositions(t *testing.T) {
+	expected := []struct {
+		typ      itemType
+		pos, end Pos
+	}{
+		{itemKey, Pos{2, 1}, Pos{2, 5}},
+		{itemQuotedString, Pos{2, 9}, Pos{2, 13}},
+		{itemKey, Pos{3, 1}, Pos{3, 3}},
+		{itemMapStart, Pos{3, 4}, Pos{3, 5}},
+		{itemKey, Pos{4, 2}, Pos{4, 6}},
+		{itemInteger, Pos{4, 7}, Pos{4, 11}},
+		{itemMapEnd, Pos{5, 2}, Pos{5, 2}},
+		{itemEOF, Pos{6, 1}, Pos{6, 1}},
+	}
+	lx := lex(positionsExample)
+	for _, ex := range expected {
+		item := lx.nextItem()
+		if item.typ != ex.typ || item.pos != ex.pos || item.end != ex.end {
+			t.Fatalf("Expected %v at %v-%v, but got %v at %v-%v",
+				ex.typ, ex.pos, ex.end, item.typ, item.pos, item.end)
+		}
+	}
+}
+
+func TestLexVariables(t *testing.T) {
+	expectedItems := []testItem{
+		{itemKey, "port", 1},
+		{itemVariable, "$base_port", 1},
+		{itemKey, "hosts", 2},
+		{itemArrayStart, "", 2},
+		{itemVariable, "${db.host}", 2},
+		{itemVariable, "$backup", 2},
+		{itemArrayEnd, "", 2},
+		{itemKey, "price", 3},
+		{itemString, "$", 3},
+		{itemEOF, "", 3},
+	}
+	lx := lex("port = $base_port\nhosts [${db.host}, $backup]\nprice = $")
+	expect(t, lx, expectedItems)
+}
+
+func TestLexDatetimes(t *testing.T) {
+	expectedItems := []testItem{
+		{itemKey, "a", 1},
+		{itemDatetime, "1979-05-27T07:32:00Z", 1},
+		{itemKey, "b", 2},
+		{itemDatetime, "1979-05-27t07:32:00.999+02:00", 2},
+		{itemKey, "c", 3},
+		{itemDatetime, "1979-05-27 07:32:00-07:00", 3},
+		{itemKey, "d", 4},
+		{itemDate, "1979-05-27", 4},
+		{itemKey, "e", 5},
+		{itemTime, "07:32:00.5", 5},
+		{itemKey, "f", 6},
+		{itemArrayStart, "", 6},
+		{itemDate, "2024-01-31", 6},
+		{itemTime, "23:59:59", 6},
+		{itemArrayEnd, "", 6},
+		{itemEOF, "", 6},
+	}
+	lx := lex(`a = 1979-05-27T07:32:00Z
+b = 1979-05-27t07:32:00.999+02:00
+c = 1979-05-27 07:32:00-07:00
+d = 1979-05-27
+e = 07:32:00.5
+f = [2024-01-31, 23:59:59]`)
+	expect(t, lx, expectedItems)
+}
+
+func TestLexDurations(t *testing.T) {
+	expectedItems := []testItem{
+		{itemKey, "timeout", 1},
+		{itemDuration, "30s", 1},
+		{itemKey, "ttl", 2},
+		{itemArrayStart, "", 2},
+		{itemDuration, "1h30m", 2},
+		{itemDuration, "1.5ms", 2},
+		{itemDuration, "-2µs", 2},
+		{itemArrayEnd, "", 2},
+		{itemEOF, "", 2},
+	}
+	lx := lex("timeout = 30s\nttl = [1h30m, 1.5ms, -2µs]")
+	expect(t, lx, expectedItems)
+}
+
+func TestLexNumbers(t *testing.T) {
+	expectedItems := []testItem{
+		{itemKey, "mask", 1},
+		{itemInteger, "0xff_ff", 1},
+		{itemKey, "perm", 2},
+		{itemInteger, "0o644", 2},
+		{itemKey, "flags", 3},
+		{itemInteger, "-0b1010", 3},
+		{itemKey, "big", 4},
+		{itemInteger, "+1_000_000", 4},
+		{itemKey, "eps", 5},
+		{itemArrayStart, "", 5},
+		{itemFloat, "1e-9", 5},
+		{itemFloat, "6.022E+23", 5},
+		{itemFloat, "1_000.5", 5},
+		{itemArrayEnd, "", 5},
+		{itemKey, "limits", 6},
+		{itemArrayStart, "", 6},
+		{itemFloat, "inf", 6},
+		{itemFloat, "-inf", 6},
+		{itemFloat, "+inf", 6},
+		{itemFloat, "nan", 6},
+		{itemArrayEnd, "", 6},
+		{itemKey, "name", 7},
+		{itemString, "info", 7},
+		{itemEOF, "", 7},
+	}
+	lx := lex(`mask = 0xff_ff
+perm = 0o644
+flags = -0b1010
+big = +1_000_000
+eps = [1e-9, 6.022E+23, 1_000.5]
+limits = [inf, -inf, +inf, nan]
+name = info`)
+	expect(t, lx, expectedItems)
+}
+
+func TestLexSizes(t *testing.T) {
+	expectedItems := []testItem{
+		{itemKey, "a", 1},
+		{itemArrayStart, "", 1},
+		{itemInteger, "1k", 1},
+		{itemInteger, "64MB", 1},
+		{itemInteger, "2GiB", 1},
+		{itemInteger, "-3mb", 1},
+		{itemInteger, "5M", 1},
+		{itemDuration, "5m", 1},
+		{itemDuration, "5ms", 1},
+		{itemArrayEnd, "", 1},
+		{itemEOF, "", 1},
+	}
+	lx := lex("a = [1k, 64MB, 2GiB, -3mb, 5M, 5m, 5ms]")
+	expect(t, lx, expectedItems)
+}
+
+func TestLexPlusString(t *testing.T) {
+	expectedItems := []testItem{
+		{itemKey, "a", 1},
+		{itemString, "+Ώ", 1},
+		{itemEOF, "", 1},
+	}
+	lx := lex("a +Ώ")
+	expect(t, lx, expectedItems)
+}
+
+func TestLexNull(t *testing.T) {
+	expectedItems := []testItem{
+		{itemKey, "a", 1},
+		{itemNull, "null", 1},
+		{itemKey, "b", 2},
+		{itemArrayStart, "", 2},
+		{itemNull, "nil", 2},
+		{itemString, "nullable", 2},
+		{itemQuotedString, "null", 2},
+		{itemArrayEnd, "", 2},
+		{itemEOF, "", 2},
+	}
+	lx := lex("a = null\nb = [nil, nullable, \"null\"]")
+	expect(t, lx, expectedItems)
+}
+
+func TestLexBlockComments(t *testing.T) {
+	expectedItems := []testItem{
+		{itemCommentStart, "", 1},
+		{itemText, " top ", 1},
+		{itemKey, "a", 2},
+		{itemCommentStart, "", 2},
+		{itemText, " key ", 2},
+		{itemCommentStart, "", 2},
+		{itemText, " value ", 2},
+		{itemInteger, "1", 2},
+		{itemCommentStart, "", 2},
+		{itemText, " after /* nested */\n", 3},
+		{itemKey, "b", 4},
+		{itemArrayStart, "", 4},
+		{itemInteger, "1", 4},
+		{itemCommentStart, "", 4},
+		{itemText, "*", 4},
+		{itemInteger, "2", 4},
+		{itemArrayEnd, "", 4},
+		{itemEOF, "", 4},
+	}
+	lx := lex("/* top */\na /* key */ = /* value */ 1 /* after /* nested */\n*/\nb = [1, /***/ 2]")
+	expect(t, lx, expectedItems)
+}
+
+func TestLexSlashAfterKey(t *testing.T) {
+	expectedItems := []testItem{
+		{itemKey, "a", 1},
+		{itemString, "/Ы", 1},
+		{itemEOF, "", 1},
+	}
+	lx := lex("a\t/Ы")
+	expect(t, lx, expectedItems)
+}
+
+func TestLexEscapes(t *testing.T) {
+	expectedItems := []testItem{
+		{itemKey, "a", 1},
+		{itemQuotedString, `x\"y\\`, 1},
+		{itemKey, "b", 2},
+		{itemRawString, `x\ny`, 2},
+		{itemKey, "c", 3},
+		{itemString, `\u00e9\x41`, 3},
+		{itemEOF, "", 3},
+	}
+	lx := lex("a = \"x\\\"y\\\\\"\nb = 'x\\ny'\nc = \\u00e9\\x41")
+	expect(t, lx, expectedItems)
+}
+
+func TestLexHeredoc(t *testing.T) {
+	expectedItems := []testItem{
+		{itemKey, "sql", 1},
+		{itemHeredoc, "SELECT ${x}\n)\n  EOD", 4},
+		{itemKey, "lua", 6},
+		{itemIndentedHeredoc, "  f()\n  end", 8},
+		{itemKey, "empty", 10},
+		{itemHeredoc, "", 10},
+		{itemEOF, "", 12},
+	}
+	lx := lex("sql = <<EOD\nSELECT ${x}\n)\n  EOD\nEOD\nlua = <<-END_1\n  f()\n  end\n  END_1\nempty = <<E\nE\n")
+	expect(t, lx, expectedItems)
+}
+
+func TestLexRoot(t *testing.T) {
+	expectedItems := []testItem{
+		{itemCommentStart, "", 1},
+		{itemText, " config", 1},
+		{itemMapStart, "", 2},
+		{itemQuotedKey, "a", 3},
+		{itemInteger, "1", 3},
+		{itemMapEnd, "", 4},
+		{itemCommentStart, "", 4},
+		{itemText, " done", 4},
+		{itemEOF, "", 5},
+	}
+	lx := lex("// config\n{\n  \"a\": 1\n} // done\n")
+	expect(t, lx, expectedItems)
+
+	expectedItems = []testItem{
+		{itemArrayStart, "", 1},
+		{itemInteger, "1", 1},
+		{itemQuotedString, "b", 1},
+		{itemArrayEnd, "", 1},
+		{itemEOF, "", 1},
+	}
+	lx = lex(` [1, "b"] `)
+	expect(t, lx, expectedItems)
+}
+
+func TestLexTables(t *testing.T) {
+	expectedItems := []testItem{
+		{itemTable, "db.primary", 1},
+		{itemKey, "host", 2},
+		{itemString, "x", 2},
+		{itemArrayTable, ` servers."a.b" `, 3},
+		{itemCommentStart, "", 3},
+		{itemText, " c", 3},
+		{itemKey, "port", 4},
+		{itemInteger, "80", 4},
+		{itemEOF, "", 4},
+	}
+	lx := lex("[db.primary]\nhost = x\n[[ servers.\"a.b\" ]] # c\nport = 80")
+	expect(t, lx, expectedItems)
+}
+
+func TestLexLabels(t *testing.T) {
+	expectedItems := []testItem{
+		{itemKey, "backend", 1},
+		{itemLabel, "s3", 1},
+		{itemLabel, `pri\"mary`, 1},
+		{itemMapStart, "", 1},
+		{itemKey, "bucket", 1},
+		{itemString, "x", 1},
+		{itemMapEnd, "", 1},
+		{itemKey, "name", 2},
+		{itemQuotedString, "s3", 2},
+		{itemEOF, "", 2},
+	}
+	lx := lex("backend \"s3\" \"pri\\\"mary\" { bucket = x }\nname = \"s3\"")
+	expect(t, lx, expectedItems)
+}
+
+func TestLexDirectives(t *testing.T) {
+	expectedItems := []testItem{
+		{itemKey, "listen", 1},
+		{itemArgsStart, "", 1},
+		{itemInteger, "80", 1},
+		{itemString, "default_server", 1},
+		{itemArgsEnd, "", 1},
+		{itemKey, "gzip", 1},
+		{itemArgsStart, "", 1},
+		{itemArgsEnd, "", 1},
+		{itemKey, "server", 2},
+		{itemMapStart, "", 2},
+		{itemKey, "root", 2},
+		{itemArgsStart, "", 2},
+		{itemString, "/var/www", 2},
+		{itemArgsEnd, "", 2},
+		{itemMapEnd, "", 2},
+		{itemKey, "port", 3},
+		{itemInteger, "8080", 3},
+		{itemEOF, "", 3},
+	}
+	lx := lex("listen 80 default_server; gzip;\nserver { root /var/www }\nport = 8080")
+	lx.dialect = NginxDialect()
+	expect(t, lx, expectedItems)
+}
+
+func TestLexOperators(t *testing.T) {
+	expectedItems := []testItem{
+		{itemKey, "plugins", 1},
+		{itemOperator, "+=", 1},
+		{itemArrayStart, "", 1},
+		{itemQuotedString, "audit", 1},
+		{itemArrayEnd, "", 1},
+		{itemKey, "hosts", 2},
+		{itemOperator, "^=", 2},
+		{itemString, "a", 2},
+		{itemUnset, "-", 3},
+		{itemKey, "legacy_mode", 3},
+		{itemKey, "server", 4},
+		{itemMapStart, "", 4},
+		{itemUnset, "unset", 4},
+		{itemQuotedKey, "tls key", 4},
+		{itemMapEnd, "", 4},
+		{itemEOF, "", 4},
+	}
+	lx := lex("plugins+= [\"audit\"]\nhosts ^= a\n-legacy_mode\nserver { unset \"tls key\" }")
+	lx.dialect = OverlayDialect()
+	expect(t, lx, expectedItems)
+
+	// Without operators, they are ordinary keys.
+	expectedItems = []testItem{
+		{itemKey, "unset", 1},
+		{itemString, "foo", 1},
+		{itemEOF, "", 1},
+	}
+	lx = lex("unset foo")
+	expect(t, lx, expectedItems)
+}
+
+func TestLexProfiles(t *testing.T) {
+	expectedItems := []testItem{
+		{itemProfile, "production", 1},
+		{itemMapStart, "", 1},
+		{itemKey, "a", 2},
+		{itemInteger, "1", 2},
+		{itemMapEnd, "", 3},
+		{itemProfile, "env(staging, production)", 4},
+		{itemMapStart, "", 4},
+		{itemUnset, "-", 4},
+		{itemKey, "b", 4},
+		{itemMapEnd, "", 4},
+		{itemEOF, "", 4},
+	}
+	lx := lex("@production {\n  a = 1\n}\n@env(staging, production){ -b }")
+	lx.dialect = OverlayDialect()
+	expect(t, lx, expectedItems)
+}
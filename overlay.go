@@ -0,0 +1,175 @@
+package confl
+
+import "fmt"
+
+// Op is the kind of an Operation.
+type Op int
+
+const (
+	// OpAppend adds values to the end of an array, `key += value`.
+	OpAppend Op = iota + 1
+
+	// OpPrepend adds values to the start of an array, `key ^= value`.
+	OpPrepend
+
+	// OpDelete deletes a key, `-key` or `unset key`.
+	OpDelete
+)
+
+var opNames = []string{"", "append", "prepend", "delete"}
+
+func (op Op) String() string {
+	if op > 0 && int(op) < len(opNames) {
+		return opNames[op]
+	}
+	return fmt.Sprintf("Op(%d)", int(op))
+}
+
+func opOf(operator string) Op {
+	if operator == opPrepend {
+		return OpPrepend
+	}
+	return OpAppend
+}
+
+// Operation is a change to the value of a key, rather than a value for it,
+// as made by an overlay on another config with Dialect.Operators.
+type Operation struct {
+	Op Op
+
+	// Value is the value appended or prepended. The values of an array are
+	// added one by one.
+	Value interface{}
+}
+
+// Operations are the operations on a key, in order. Parsing sets a key to
+// its Operations when it changes a key that wasn't set earlier in the same
+// data, so that Merge can apply them to the value of the key in another
+// config, while decoding applies them to nothing.
+type Operations []Operation
+
+// apply returns the value of the key after the operation, given its value
+// before, if it had one. The returned bool is false when the key is deleted.
+func (op Operation) apply(key Key, old interface{}, exists bool) (interface{}, bool, error) {
+	if op.Op == OpDelete {
+		return nil, false, nil
+	}
+	var array []interface{}
+	if exists && old != nil {
+		var ok bool
+		if array, ok = old.([]interface{}); !ok {
+			return nil, false, e("Cannot %s to '%s', which is not an array.", op.Op, key)
+		}
+	}
+	values, ok := op.Value.([]interface{})
+	if !ok {
+		values = []interface{}{op.Value}
+	}
+	if op.Op == OpPrepend {
+		array, values = values, array
+	}
+	changed := make([]interface{}, 0, len(array)+len(values))
+	changed = append(changed, array...)
+	return append(changed, values...), true, nil
+}
+
+func (ops Operations) apply(key Key, old interface{}, exists bool) (interface{}, bool, error) {
+	var err error
+	for _, op := range ops {
+		if old, exists, err = op.apply(key, old, exists); err != nil {
+			return nil, false, err
+		}
+	}
+	return old, exists, nil
+}
+
+// Merge returns the hash of a config parsed from base with the one parsed
+// from overlay laid over it. Keys set in overlay replace those in base,
+// hashes set in both are merged, key by key, and Operations in overlay are
+// applied to the values of their keys in base. When base has Operations of
+// its own for a key, those of overlay are added to them. Neither base nor
+// overlay is changed.
+func Merge(base, overlay map[string]interface{}) (map[string]interface{}, error) {
+	merged := copyHash(base)
+	if err := mergeInto(merged, overlay, nil, true); err != nil {
+		return nil, err
+	}
+	return merged, nil
+}
+
+// mergeInto lays overlay over the hash dst, which is changed. The hashes
+// within dst are changed too, unless copy is true, in which case any that
+// are merged with are copied first.
+func mergeInto(dst, overlay map[string]interface{}, context Key, copy bool) error {
+	for k, v := range overlay {
+		old, exists := dst[k]
+		switch v := v.(type) {
+		case Operations:
+			if ops, ok := old.(Operations); ok {
+				dst[k] = append(ops[:len(ops):len(ops)], v...)
+				continue
+			}
+			val, ok, err := v.apply(context.add(k), old, exists)
+			if err != nil {
+				return err
+			}
+			if ok {
+				dst[k] = val
+			} else {
+				delete(dst, k)
+			}
+		case map[string]interface{}:
+			hash, ok := old.(map[string]interface{})
+			if !ok || copy {
+				hash = copyHash(hash)
+			}
+			if err := mergeInto(hash, v, context.add(k), copy); err != nil {
+				return err
+			}
+			dst[k] = hash
+		default:
+			dst[k] = v
+		}
+	}
+	return nil
+}
+
+func copyHash(hash map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(hash))
+	for k, v := range hash {
+		copied[k] = v
+	}
+	return copied
+}
+
+// setOperation sets the next key to the result of op on the value the key
+// was set to earlier in the data. When it wasn't, or op deletes it, the key
+// is set to the operations instead, for Merge to apply.
+func (p *parser) setOperation(op Operation) *ParseError {
+	ctx := p.ctx.(map[string]interface{})
+	key := p.topKey()
+	old, exists := ctx[key]
+	ops, isOps := old.(Operations)
+	p.forgetRepeated(ctx, key)
+	switch {
+	case op.Op == OpDelete || !exists:
+		ctx[key] = Operations{op}
+	case isOps:
+		ctx[key] = append(ops, op)
+	default:
+		span := p.keySpans[len(p.keySpans)-1]
+		if _, ok := old.(*reference); ok {
+			return p.errorf(span.Start, "Cannot %s to '%s', which refers to another key.",
+				op.Op, p.nextKey())
+		}
+		val, _, err := op.apply(p.nextKey(), old, exists)
+		if err != nil {
+			return p.errorf(span.Start, "%s", err)
+		}
+		ctx[key] = val
+	}
+	p.popKey()
+	p.currentKey = ""
+	p.leaveDottedKey()
+	return nil
+}
@@ -15,11 +15,14 @@ package confl
 // see parse_test.go for more examples.
 
 import (
+	"bytes"
 	"fmt"
-	"log"
+	"math"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf16"
 	"unicode/utf8"
 
 	u "github.com/araddon/gou"
@@ -35,6 +38,9 @@ type parser struct {
 	types   map[string]confType
 	lx      *lexer
 
+	// The array that is the whole document, if it is one rather than a hash.
+	root interface{}
+
 	// A list of keys in the order that they appear in the data.
 	ordered []Key
 
@@ -44,8 +50,8 @@ type parser struct {
 	// the base key name for everything except hashes
 	currentKey string
 
-	// rough approximation of line number
-	approxLine int
+	// position of the item being processed
+	pos Pos
 
 	// The current scoped context, can be array or map
 	ctx interface{}
@@ -53,62 +59,303 @@ type parser struct {
 	// stack of contexts, either map or array/slice stack
 	ctxs []interface{}
 
+	// stack of scopes, one for each context in ctxs
+	scopes []scope
+
 	// Keys stack
 	keys []string
 
+	// where each key in the keys stack was found
+	keySpans []Span
+
+	// where each key and its value were found, by full key name
+	positions map[string]Position
+
 	// A map of 'key.group.names' to whether they were created implicitly.
 	implicits map[string]bool
+
+	// Whether to keep parsing after an error, and the errors found so far.
+	collect bool
+	errors  ErrorList
+
+	// Reads included files, or nil if includes are not enabled.
+	includer *includer
+
+	// stack of files being parsed, the innermost include last
+	sources []source
+
+	// Whether the next item is the file name of an include directive.
+	including bool
+
+	// Whether the next hash is the block for the label just read.
+	labeled bool
+
+	// Whether the next key is deleted, and the operation for the value of
+	// the key pushed when the keys stack had opKeys keys on it, if any.
+	unsetting bool
+	op        Op
+	opKeys    int
+
+	// References to other keys, to be resolved once parsing is done.
+	refs []*reference
+
+	// stack of references being resolved, to catch cycles
+	resolving []*reference
+
+	// Resolvers by scheme, or nil if resolvers are not allowed.
+	resolvers map[string]Resolver
+
+	// The syntax to accept, and whether unquoted keys with dots name
+	// nested hashes.
+	dialect Dialect
+	dotted  bool
+
+	// What to do with keys set more than once, where each such key was set
+	// before, and which keys have had their values collected into arrays.
+	duplicates DuplicateKeys
+	previous   map[string]Position
+	repeated   map[hashKey]bool
+
+	// The arrays made by array of tables headers, by full key name.
+	tableArrays map[string]bool
+
+	// The profiles selected, and the sections for profiles, in order. Keys
+	// are set in the hash of the section being parsed, if any, and the
+	// section of the next hash, if it is one.
+	profiles []string
+	sections []*section
+	section  *section
+
+	// The profiles of the keys set by the sections of selected profiles.
+	keyProfiles map[string]string
+
+	// The arguments of each directive set so far, by full key name.
+	directives map[string][][]interface{}
+
+	// Whether the value of a key with an error is being skipped, and how
+	// deeply nested in its hashes and arrays the parser is.
+	skipping  bool
+	skipDepth int
+}
+
+// scope is what the parser tracks for each context on the stack.
+type scope struct {
+	key      Key  // the full key of the context
+	keys     int  // the size of the keys stack when the context was entered
+	implicit bool // whether the context was entered for a dotted key
+	root     bool // whether the context is the object or array of a document
+	table    bool // whether the context was entered for a table header
+	profile  bool // whether the context is the section of a profile
 }
 
-type parseError string
+// ParseError is returned when data cannot be parsed. It describes where
+// the problem was found, so tools can point at it without having to pick
+// apart the error message.
+type ParseError struct {
+	File    string // The file containing the problem, if known.
+	Line    int    // The line of the problem, starting at 1.
+	Column  int    // The column of the problem, starting at 1, in runes.
+	KeyPath Key    // The key being parsed when the problem was found, if any.
+	Msg     string // A description of the problem.
+	Source  string // The line of data containing the problem.
+}
+
+// Error returns a description of the problem, followed by the offending
+// line of data with a caret under the column of the problem.
+func (pe *ParseError) Error() string {
+	var buf bytes.Buffer
+	buf.WriteString("Parse error")
+	if pe.File != "" {
+		fmt.Fprintf(&buf, " in '%s'", pe.File)
+	}
+	fmt.Fprintf(&buf, " on line %d, column %d", pe.Line, pe.Column)
+	if len(pe.KeyPath) > 0 {
+		fmt.Fprintf(&buf, ", key '%s'", pe.KeyPath)
+	}
+	fmt.Fprintf(&buf, ": %s", pe.Msg)
+	if pe.Source == "" {
+		return buf.String()
+	}
+	fmt.Fprintf(&buf, "\n%s\n", pe.Source)
+	// Keep tabs so the caret lines up with the source however it's shown.
+	for i, r := range []rune(pe.Source) {
+		if i >= pe.Column-1 {
+			break
+		}
+		if r == '\t' {
+			buf.WriteRune('\t')
+		} else {
+			buf.WriteRune(' ')
+		}
+	}
+	buf.WriteRune('^')
+	return buf.String()
+}
+
+// ErrorList is every problem found in data parsed with CollectErrors, in
+// the order they were found.
+type ErrorList []*ParseError
 
-func (pe parseError) Error() string {
-	return string(pe)
+func (el ErrorList) Error() string {
+	msgs := make([]string, len(el))
+	for i, pe := range el {
+		msgs[i] = pe.Error()
+	}
+	return strings.Join(msgs, "\n")
 }
 
+// Parse returns the keys and values of data. Data that is a single object,
+// like a JSON document, is returned as its keys, but data that is an array
+// can only be decoded, into a slice.
 func Parse(data string) (map[string]interface{}, error) {
-	p, err := parse(data)
-	if err != nil {
+	return ParseWithOptions(data, DecodeOptions{})
+}
+
+// ParseAll is like Parse, except it keeps going after a syntax error to
+// find every problem in the data, which are returned as an ErrorList.
+// Whatever could be parsed is returned along with the errors.
+func ParseAll(data string) (map[string]interface{}, error) {
+	return ParseWithOptions(data, DecodeOptions{CollectErrors: true})
+}
+
+// ParseWithOptions is just like Parse, except parsing is controlled by opts,
+// such as the Dialect to accept.
+func ParseWithOptions(data string, opts DecodeOptions) (map[string]interface{}, error) {
+	p, err := parse(data, opts)
+	switch {
+	case p == nil:
 		return nil, err
+	case p.root != nil && err == nil:
+		return nil, errArrayRoot
 	}
-	return p.mapping, nil
+	return p.mapping, err
 }
 
-func parse(data string) (p *parser, err error) {
+var errArrayRoot = e("The document is an array, and can only be decoded into a slice.")
 
+func parse(data string, opts DecodeOptions) (p *parser, err error) {
+	dialect := opts.dialect()
 	p = &parser{
-		mapping: make(map[string]interface{}),
-		lx:      lex(data),
-		ctxs:    make([]interface{}, 0, 4),
-		keys:    make([]string, 0, 4),
+		mapping:   make(map[string]interface{}),
+		types:     make(map[string]confType),
+		lx:        lex(data),
+		ctxs:      make([]interface{}, 0, 4),
+		scopes:    make([]scope, 0, 4),
+		keys:      make([]string, 0, 4),
+		keySpans:  make([]Span, 0, 4),
+		positions: make(map[string]Position),
+		implicits: make(map[string]bool),
+		collect:   opts.CollectErrors,
+		includer:  newIncluder(opts),
+		resolvers: newResolvers(opts),
+		dialect:   dialect,
+		dotted:    opts.DottedKeys || dialect.DottedKeys,
+
+		duplicates: opts.DuplicateKeys,
+		previous:   make(map[string]Position),
+		repeated:   make(map[hashKey]bool),
+
+		tableArrays: make(map[string]bool),
+		directives:  make(map[string][][]interface{}),
+		profiles:    opts.profiles(),
+		keyProfiles: make(map[string]string),
+	}
+	p.lx.recover = opts.CollectErrors
+	p.lx.dialect = dialect
+	p.sources = []source{{lx: p.lx, file: opts.file, dir: opts.IncludeDir}}
+	if opts.file != "" {
+		p.sources[0].dir = filepath.Dir(opts.file)
+	}
+	if p.sources[0].dir == "" {
+		p.sources[0].dir = "."
 	}
-	p.pushContext(p.mapping)
+	p.pushContext(p.mapping, Key{})
+
+	defer func() {
+		if r := recover(); r != nil {
+			// Malformed data must never take down the process, so any
+			// panic while parsing, even a bug, is returned as an error.
+			perr, ok := r.(*ParseError)
+			if !ok {
+				perr = p.errorf(p.pos, "BUG: %v", r)
+			}
+			if p.collect {
+				err = append(p.errors, perr)
+			} else {
+				p, err = nil, perr
+			}
+		}
+	}()
 
 	for {
 		it := p.next()
 		if it.typ == itemEOF {
 			break
 		}
-		if err := p.processItem(it); err != nil {
-			return nil, err
+		if perr := p.processItem(it); perr != nil {
+			if !p.collect {
+				return nil, perr
+			}
+			p.errors = append(p.errors, perr)
+			p.dropKeys()
 		}
 	}
 
+	if perr := p.applyProfiles(); perr != nil {
+		if !p.collect {
+			return nil, perr
+		}
+		p.errors = append(p.errors, perr)
+	}
+	if perr := p.resolveReferences(); perr != nil {
+		return nil, perr
+	}
+	p.moveProfileKeys()
+	if len(p.errors) > 0 {
+		return p, p.errors
+	}
 	return p, nil
 }
 
 func (p *parser) panicf(format string, v ...interface{}) {
-	msg := fmt.Sprintf("Near line %d, key '%s': %s",
-		p.approxLine, p.current(), fmt.Sprintf(format, v...))
-	panic(parseError(msg))
+	panic(p.errorf(p.pos, format, v...))
+}
+
+// errorf returns a ParseError for a problem at the given position, keyed by
+// the key currently being parsed.
+func (p *parser) errorf(pos Pos, format string, v ...interface{}) *ParseError {
+	keyPath := make(Key, 0, len(p.context)+1)
+	keyPath = append(keyPath, p.context...)
+	if p.currentKey != "" {
+		keyPath = append(keyPath, p.currentKey)
+	}
+	return newParseError(p.file(), p.lx.input, pos, keyPath, fmt.Sprintf(format, v...))
 }
 
+func newParseError(file, data string, pos Pos, keyPath Key, msg string) *ParseError {
+	return &ParseError{
+		File:    file,
+		Line:    pos.Line,
+		Column:  pos.Column,
+		KeyPath: keyPath,
+		Msg:     msg,
+		Source:  sourceLine(data, pos.Line),
+	}
+}
+
+// next returns the next item, carrying on with the file that included the
+// current one when it ends.
 func (p *parser) next() item {
-	return p.lx.nextItem()
+	it := p.lx.nextItem()
+	for it.typ == itemEOF && p.endSource() {
+		it = p.lx.nextItem()
+	}
+	return it
 }
 
+// bug stops parsing with an error for a broken invariant in the parser.
 func (p *parser) bug(format string, v ...interface{}) {
-	log.Fatalf("BUG: %s\n\n", fmt.Sprintf(format, v...))
+	p.panicf("BUG: %s", fmt.Sprintf(format, v...))
 }
 
 func (p *parser) expect(typ itemType) item {
@@ -119,106 +366,342 @@ func (p *parser) expect(typ itemType) item {
 
 func (p *parser) assertEqual(expected, got itemType) {
 	if expected != got {
-		p.bug("Expected '%s' but got '%s'.", expected, got)
+		p.bug("Expected '%v' but got '%v'.", expected, got)
 	}
 }
 
-func (p *parser) pushContext(ctx interface{}) {
+func (p *parser) pushContext(ctx interface{}, key Key) {
 	p.ctxs = append(p.ctxs, ctx)
+	p.scopes = append(p.scopes, scope{key: key, keys: len(p.keys)})
 	p.ctx = ctx
+	p.context = key
+	p.currentKey = ""
 }
 
 func (p *parser) popContext() interface{} {
-	if len(p.ctxs) == 0 {
-		panic("BUG in parser, context stack empty")
+	if len(p.ctxs) <= 1 {
+		p.bug("Context stack empty.")
 	}
 	li := len(p.ctxs) - 1
 	last := p.ctxs[li]
 	p.ctxs = p.ctxs[0:li]
+	p.scopes = p.scopes[0:li]
 	p.ctx = p.ctxs[len(p.ctxs)-1]
+	p.context = p.scopes[len(p.scopes)-1].key
+	p.currentKey = ""
 	return last
 }
 
-func (p *parser) pushKey(key string) {
+func (p *parser) pushKey(key string, span Span) {
 	p.keys = append(p.keys, key)
+	p.keySpans = append(p.keySpans, span)
 }
 
 func (p *parser) popKey() string {
 	if len(p.keys) == 0 {
-		panic("BUG in parser, keys stack empty")
+		p.bug("Keys stack empty.")
 	}
 	li := len(p.keys) - 1
 	last := p.keys[li]
 	p.keys = p.keys[0:li]
+	p.keySpans = p.keySpans[0:li]
 	return last
 }
 
-func (p *parser) processItem(it item) error {
+// dropKeys discards any keys in the current context that were left without
+// a value by an error, so parsing can carry on with the next key.
+func (p *parser) dropKeys() {
+	p.leaveDottedKey()
+	n := p.scopes[len(p.scopes)-1].keys
+	p.keys = p.keys[0:n]
+	p.keySpans = p.keySpans[0:n]
+	p.currentKey = ""
+	p.op, p.unsetting = 0, false
+	p.labeled = false
+}
+
+// nextKey returns the full key of the next value to be set in the current
+// context. Values inside of arrays are keyed by their index, e.g.
+// `servers[0]`.
+func (p *parser) nextKey() Key {
+	switch ctx := p.ctx.(type) {
+	case []interface{}:
+		return p.context.index(len(ctx))
+	case map[string]interface{}:
+		return p.context.add(p.topKey())
+	}
+	return p.context
+}
+
+// topKey returns the key of the next value to be set in a hash.
+func (p *parser) topKey() string {
+	if len(p.keys) == 0 {
+		p.bug("No key for value in context '%s'.", p.context)
+	}
+	return p.keys[len(p.keys)-1]
+}
+
+// addKey records the key of the next value to be set in the current context,
+// in the order it appears in the data, along with its type and position.
+// Values inside of arrays are not keys themselves, and are not recorded.
+func (p *parser) addKey(typ confType, it item) {
+	if _, ok := p.ctx.(map[string]interface{}); !ok {
+		return
+	}
+	key := p.nextKey()
+	p.ordered = append(p.ordered, key)
+	p.setType(p.topKey(), typ)
+	if pos, ok := p.positions[key.String()]; ok {
+		p.previous[key.String()] = pos
+	}
+	p.positions[key.String()] = Position{
+		File:  p.file(),
+		Key:   p.keySpans[len(p.keySpans)-1],
+		Value: it.span(),
+	}
+}
+
+// endKey extends the value position of the next key to be set in the
+// current context up to the end of the given item, e.g. the '}' closing
+// a hash.
+func (p *parser) endKey(it item) {
+	if _, ok := p.ctx.(map[string]interface{}); !ok {
+		return
+	}
+	key := p.nextKey().String()
+	pos := p.positions[key]
+	pos.Value.End = it.end
+	p.positions[key] = pos
+}
+
+func (p *parser) processItem(it item) *ParseError {
+	p.pos = it.pos
+	if it.typ == itemCommentStart || it.typ == itemText {
+		// Comments can come between any two items.
+		return nil
+	}
+	if p.skipping {
+		return p.skip(it)
+	}
+	if p.including && it.typ != itemError {
+		p.including = false
+		if it.typ != itemString && it.typ != itemQuotedString && it.typ != itemRawString {
+			return p.errorf(it.pos, "Expected a file name to include, but got '%s'.", it.val)
+		}
+		return p.include(it)
+	}
 	switch it.typ {
 	case itemError:
-		//panic("error")
-		return fmt.Errorf("Parse error on line %d: '%s'", it.line, it.val)
-	case itemKey:
-		p.pushKey(it.val)
+		p.including, p.unsetting = false, false
+		return p.errorf(it.pos, "%s", it.val)
+	case itemInclude:
+		p.including = true
+	case itemUnset:
+		p.unsetting = true
+	case itemOperator:
+		p.op, p.opKeys = opOf(it.val), len(p.keys)
+	case itemKey, itemQuotedKey:
+		unset := p.unsetting
+		p.unsetting = false
+		if it.typ == itemKey && p.dotted && strings.Contains(it.val, ".") {
+			if perr := p.dottedKey(it); perr != nil {
+				return perr
+			}
+		} else {
+			p.pushKey(it.val, it.span())
+			p.currentKey = it.val
+		}
+		if unset {
+			p.addKey(nil, it)
+			return p.setOperation(Operation{Op: OpDelete})
+		}
+	case itemTable, itemArrayTable:
+		return p.tableHeader(it)
+	case itemLabel:
+		return p.label(it)
+	case itemProfile:
+		return p.startSection(it)
+	case itemArgsStart:
+		p.addKey(confArray, it)
+		p.pushContext(make([]interface{}, 0), p.nextKey())
+	case itemArgsEnd:
+		return p.endDirective(it)
 	case itemMapStart:
+		if p.section != nil {
+			p.enterSection()
+			return nil
+		}
+		if p.atRoot() {
+			// The hash is the whole document, so its keys are set where
+			// they would be without it.
+			p.pushContext(p.ctx, p.context)
+			p.scopes[len(p.scopes)-1].root = true
+			return nil
+		}
 		newCtx := make(map[string]interface{})
-		p.pushContext(newCtx)
+		if hash, ok := p.existingHash(); ok {
+			// With dotted keys, blocks for the same key are merged.
+			newCtx = hash
+		} else if hash, ok := p.labeledHash(); ok {
+			newCtx = hash
+		}
+		p.labeled = false
+		p.addKey(confHash, it)
+		p.pushContext(newCtx, p.nextKey())
 	case itemMapEnd:
-		p.setValue(p.popContext())
-	case itemString:
-		// FIXME(dlc) sanitize string?
-		p.setValue(maybeRemoveIndents(it.val))
+		if _, ok := p.ctx.(map[string]interface{}); !ok {
+			p.bug("Unexpected end of hash in array.")
+		}
+		if p.scopes[len(p.scopes)-1].profile {
+			p.leaveSection()
+			return nil
+		}
+		root := p.scopes[len(p.scopes)-1].root
+		hash := p.popContext()
+		if root {
+			return nil
+		}
+		p.endKey(it)
+		return p.setValue(hash)
+	case itemString, itemQuotedString:
+		s := maybeRemoveIndents(it.val)
+		if it.typ == itemQuotedString {
+			// Only double-quoted strings have escapes, as unquoted ones are
+			// often paths, e.g. `C:\new`.
+			var err error
+			if s, err = unescape(s); err != nil {
+				return p.errorf(it.pos, "Invalid string: %s.", err)
+			}
+		}
+		p.addKey(p.typeOfPrimitive(it), it)
+		if strings.Contains(s, "${") {
+			return p.setValue(p.newReference(it, s))
+		} else {
+			return p.setValue(s)
+		}
+	case itemBlockString:
+		// Block strings are left as written, as they often hold scripts.
+		p.addKey(p.typeOfPrimitive(it), it)
+		return p.setValue(maybeRemoveIndents(it.val))
+	case itemRawString:
+		p.addKey(p.typeOfPrimitive(it), it)
+		return p.setValue(maybeRemoveIndents(it.val))
+	case itemHeredoc:
+		p.addKey(p.typeOfPrimitive(it), it)
+		return p.setValue(it.val)
+	case itemIndentedHeredoc:
+		p.addKey(p.typeOfPrimitive(it), it)
+		return p.setValue(maybeRemoveIndents(it.val))
+	case itemVariable:
+		// The type is set once the reference is resolved.
+		p.addKey(nil, it)
+		return p.setValue(p.newReference(it, ""))
 	case itemInteger:
-		num, err := strconv.ParseInt(it.val, 10, 64)
+		num, err := parseInteger(it.val)
 		if err != nil {
 			if e, ok := err.(*strconv.NumError); ok &&
 				e.Err == strconv.ErrRange {
-				return fmt.Errorf("Integer '%s' is out of the range.", it.val)
+				return p.errorf(it.pos, "Integer '%s' is out of the range.", it.val)
 			} else {
-				return fmt.Errorf("Expected integer, but got '%s'.", it.val)
+				return p.errorf(it.pos, "Expected integer, but got '%s'.", it.val)
 			}
 		}
-		p.setValue(num)
+		p.addKey(p.typeOfPrimitive(it), it)
+		return p.setValue(num)
 	case itemFloat:
-		num, err := strconv.ParseFloat(it.val, 64)
+		num, err := strconv.ParseFloat(strings.Replace(it.val, "_", "", -1), 64)
 		if err != nil {
 			if e, ok := err.(*strconv.NumError); ok &&
 				e.Err == strconv.ErrRange {
-				return fmt.Errorf("Float '%s' is out of the range.", it.val)
+				return p.errorf(it.pos, "Float '%s' is out of the range.", it.val)
 			} else {
-				return fmt.Errorf("Expected float, but got '%s'.", it.val)
+				return p.errorf(it.pos, "Expected float, but got '%s'.", it.val)
 			}
 		}
-		p.setValue(num)
+		p.addKey(p.typeOfPrimitive(it), it)
+		return p.setValue(num)
 	case itemBool:
+		p.addKey(p.typeOfPrimitive(it), it)
 		switch it.val {
 		case "true":
-			p.setValue(true)
+			return p.setValue(true)
 		case "false":
-			p.setValue(false)
+			return p.setValue(false)
 		default:
-			return fmt.Errorf("Expected boolean value, but got '%s'.", it.val)
+			return p.errorf(it.pos, "Expected boolean value, but got '%s'.", it.val)
 		}
+	case itemNull:
+		p.addKey(p.typeOfPrimitive(it), it)
+		return p.setValue(nil)
 	case itemDatetime:
-		dt, err := time.Parse("2006-01-02T15:04:05Z", it.val)
+		// The lexer also allows a 't' or a space before the time, and a 'z'.
+		val := []byte(strings.ToUpper(it.val))
+		val[10] = 'T'
+		dt, err := time.Parse(time.RFC3339, string(val))
+		if err != nil {
+			return p.errorf(it.pos,
+				"Expected RFC 3339 formatted datetime, but got '%s': %s", it.val, err)
+		}
+		p.addKey(p.typeOfPrimitive(it), it)
+		return p.setValue(dt)
+	case itemDuration:
+		d, err := time.ParseDuration(it.val)
+		if err != nil {
+			return p.errorf(it.pos, "Expected duration such as '1h30m', but got '%s'.", it.val)
+		}
+		p.addKey(p.typeOfPrimitive(it), it)
+		return p.setValue(d)
+	case itemDate:
+		date, err := ParseDate(it.val)
+		if err != nil {
+			return p.errorf(it.pos, "Expected date, but got '%s': %s", it.val, err)
+		}
+		p.addKey(p.typeOfPrimitive(it), it)
+		return p.setValue(date)
+	case itemTime:
+		tod, err := ParseTimeOfDay(it.val)
 		if err != nil {
-			return fmt.Errorf(
-				"Expected Zulu formatted DateTime, but got '%s'.", it.val)
+			return p.errorf(it.pos, "Expected time of day, but got '%s': %s", it.val, err)
 		}
-		p.setValue(dt)
+		p.addKey(p.typeOfPrimitive(it), it)
+		return p.setValue(tod)
 	case itemArrayStart:
 		array := make([]interface{}, 0)
-		p.pushContext(array)
+		if p.atRoot() {
+			if len(p.sources) > 1 || len(p.ctxs) > 1 {
+				p.skipping, p.skipDepth = true, 1
+				return p.errorf(it.pos, "An included file cannot be an array.")
+			}
+			p.pushContext(array, p.context)
+			p.scopes[len(p.scopes)-1].root = true
+			return nil
+		}
+		p.addKey(confArray, it)
+		p.pushContext(array, p.nextKey())
 	case itemArrayEnd:
-		array := p.ctx
+		array, ok := p.ctx.([]interface{})
+		if !ok {
+			p.bug("Unexpected end of array in hash.")
+		}
+		root := p.scopes[len(p.scopes)-1].root
 		p.popContext()
-		p.setValue(array)
+		if root {
+			p.root = array
+			return nil
+		}
+		if _, ok := p.ctx.(map[string]interface{}); ok {
+			// Now that all of its values are known, an array of hashes
+			// can be told apart from other arrays.
+			p.setType(p.topKey(), typeOfArrayValues(array))
+		}
+		p.endKey(it)
+		return p.setValue(array)
 	}
 
 	return nil
 }
 
-func (p *parser) setValue(val interface{}) {
+func (p *parser) setValue(val interface{}) *ParseError {
 	// Test to see if we are on an array or a map
 
 	// Array processing
@@ -229,10 +712,193 @@ func (p *parser) setValue(val interface{}) {
 
 	// Map processing
 	if ctx, ok := p.ctx.(map[string]interface{}); ok {
+		if p.op != 0 && len(p.keys) == p.opKeys {
+			op := Operation{Op: p.op, Value: val}
+			p.op = 0
+			return p.setOperation(op)
+		}
+		if perr := p.checkRedefinition(ctx, val); perr != nil {
+			return perr
+		}
+		// Operations on the key are replaced by a value, as they would be by
+		// Merge.
+		old, ok := ctx[p.topKey()]
+		if _, isOps := old.(Operations); ok && !isOps {
+			var perr *ParseError
+			if val, perr = p.duplicateValue(ctx, old, val); perr != nil {
+				return perr
+			}
+		}
 		key := p.popKey()
-		// FIXME(dlc), make sure to error if redefining same key?
+		p.currentKey = ""
 		ctx[key] = val
+		p.leaveDottedKey()
+	}
+	return nil
+}
+
+// dottedKey enters the hashes named by all but the last part of a dotted
+// key such as `db.primary.host`, creating any that don't exist yet, and
+// pushes the last part as the key of the value to come. The hashes are left
+// again once the value has been set.
+func (p *parser) dottedKey(it item) *ParseError {
+	parts := strings.Split(it.val, ".")
+	for _, part := range parts {
+		if part == "" {
+			return p.keyError(it, "Invalid dotted key '%s'.", it.val)
+		}
+	}
+	for _, part := range parts[:len(parts)-1] {
+		p.pushKey(part, it.span())
+		p.currentKey = part
+		if perr := p.enterKey(it); perr != nil {
+			return perr
+		}
+	}
+	last := parts[len(parts)-1]
+	p.pushKey(last, it.span())
+	p.currentKey = last
+	return nil
+}
+
+// label makes the block for the key just read, `backend "s3" { }`, the block
+// for the label within a hash for the key, as if the key were `backend.s3`.
+// Blocks for the same key with other labels are collected in the same hash.
+func (p *parser) label(it item) *ParseError {
+	if perr := p.enterKey(it); perr != nil {
+		return perr
+	}
+	p.pushKey(it.val, it.span())
+	p.currentKey = it.val
+	p.labeled = true
+	return nil
+}
+
+// enterKey enters the hash for the key just pushed, creating it if it doesn't
+// exist yet, until the value to come has been set.
+func (p *parser) enterKey(it item) *ParseError {
+	ctx, ok := p.ctx.(map[string]interface{})
+	if !ok {
+		p.bug("Unexpected key in array.")
+	}
+	part := p.topKey()
+	hash, ok := ctx[part].(map[string]interface{})
+	if _, exists := ctx[part]; exists && !ok {
+		return p.keyError(it, "Key '%s' is already defined, and is not a hash.", p.nextKey())
+	}
+	if !ok {
+		hash = make(map[string]interface{})
+		ctx[part] = hash
+		p.addKey(confHash, it)
+		p.addImplicit(p.nextKey())
+	}
+	key := p.nextKey()
+	p.popKey()
+	p.pushContext(hash, key)
+	p.scopes[len(p.scopes)-1].implicit = true
+	return nil
+}
+
+// keyError returns an error for a key that can't be used, and skips its
+// value so that parsing can carry on after it.
+func (p *parser) keyError(it item, format string, v ...interface{}) *ParseError {
+	p.skipping = true
+	return p.errorf(it.pos, format, v...)
+}
+
+// skip passes over the value of a key with an error, up to the end of any
+// hash or array it starts.
+func (p *parser) skip(it item) *ParseError {
+	switch it.typ {
+	case itemError:
+		if p.skipDepth == 0 {
+			// The value itself was bad, so there is nothing left to skip.
+			p.skipping = false
+		}
+		return p.errorf(it.pos, "%s", it.val)
+	case itemMapStart, itemArrayStart, itemArgsStart:
+		p.skipDepth++
+	case itemMapEnd, itemArrayEnd, itemArgsEnd:
+		p.skipDepth--
+	case itemOperator, itemLabel:
+		// The value comes next.
+		return nil
+	}
+	p.skipping = p.skipDepth > 0
+	return nil
+}
+
+// atRoot returns true if the next value has no key, which can only be the
+// object or array that is the whole document.
+func (p *parser) atRoot() bool {
+	_, ok := p.ctx.(map[string]interface{})
+	return ok && len(p.keys) == p.scopes[len(p.scopes)-1].keys
+}
+
+// leaveDottedKey leaves the hashes entered for a dotted key once its value
+// has been set.
+func (p *parser) leaveDottedKey() {
+	for len(p.scopes) > 1 && p.scopes[len(p.scopes)-1].implicit {
+		p.popContext()
+	}
+}
+
+// existingHash returns the hash already set for the next key, if there is
+// one, when dotted keys are enabled. When duplicate keys are errors or
+// collected into arrays, only a hash made for dotted keys is returned, and
+// only the first time.
+func (p *parser) existingHash() (map[string]interface{}, bool) {
+	ctx, ok := p.ctx.(map[string]interface{})
+	if !ok || !p.dotted {
+		return nil, false
+	}
+	hash, ok := ctx[p.topKey()].(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	switch p.duplicates {
+	case DuplicateError, DuplicateImplicitArray:
+		key := p.nextKey()
+		if !p.isImplicit(key) {
+			return nil, false
+		}
+		p.removeImplicit(key)
+	}
+	return hash, true
+}
+
+// labeledHash returns the hash already set for the label of the next hash,
+// if there is one, so that blocks with the same labels are merged.
+func (p *parser) labeledHash() (map[string]interface{}, bool) {
+	ctx, ok := p.ctx.(map[string]interface{})
+	if !ok || !p.labeled {
+		return nil, false
+	}
+	hash, ok := ctx[p.topKey()].(map[string]interface{})
+	return hash, ok
+}
+
+// checkRedefinition returns an error when, with dotted keys, setting val
+// for the next key would replace a hash with another kind of value, or the
+// other way round, as hashes can be added to but not replaced.
+func (p *parser) checkRedefinition(ctx map[string]interface{}, val interface{}) *ParseError {
+	if !p.dotted || p.duplicates == DuplicateImplicitArray {
+		return nil
+	}
+	old, ok := ctx[p.topKey()]
+	if !ok {
+		return nil
 	}
+	_, isOldHash := old.(map[string]interface{})
+	_, isNewHash := val.(map[string]interface{})
+	span := p.keySpans[len(p.keySpans)-1]
+	switch {
+	case isOldHash && !isNewHash:
+		return p.errorf(span.Start, "Key '%s' is already defined as a hash.", p.nextKey())
+	case !isOldHash && isNewHash:
+		return p.errorf(span.Start, "Key '%s' is already defined, and is not a hash.", p.nextKey())
+	}
+	return nil
 }
 
 // setType sets the type of a particular value at a given key.
@@ -267,15 +933,40 @@ func (p *parser) isImplicit(key Key) bool {
 	return p.implicits[key.String()]
 }
 
-// current returns the full key name of the current context.
-func (p *parser) current() string {
-	if len(p.currentKey) == 0 {
-		return p.context.String()
+// parseInteger parses a decimal integer, or a hexadecimal, octal or binary
+// one with a prefix like `0x`, with optional underscores between digits.
+// Unlike in Go, a leading 0 alone does not make an integer octal. Decimal
+// integers may have a size suffix, like `64MB`.
+func parseInteger(s string) (int64, error) {
+	digits := strings.TrimLeft(s, "+-")
+	if len(digits) > 1 && digits[0] == '0' && isBasePrefix(rune(digits[1])) {
+		return strconv.ParseInt(s, 0, 64)
+	}
+	num, mult := splitSizeSuffix(s)
+	n, err := strconv.ParseInt(strings.Replace(num, "_", "", -1), 10, 64)
+	if err != nil || mult == 1 {
+		return n, err
 	}
-	if len(p.context) == 0 {
-		return p.currentKey
+	if n > math.MaxInt64/mult || n < math.MinInt64/mult {
+		return 0, &strconv.NumError{Func: "ParseInt", Num: s, Err: strconv.ErrRange}
 	}
-	return fmt.Sprintf("%s.%s", p.context, p.currentKey)
+	return n * mult, nil
+}
+
+// sourceLine returns the given line of data, starting at 1, without its
+// line ending.
+func sourceLine(data string, line int) string {
+	for i := 1; i < line; i++ {
+		nl := strings.IndexByte(data, '\n')
+		if nl < 0 {
+			return ""
+		}
+		data = data[nl+1:]
+	}
+	if nl := strings.IndexByte(data, '\n'); nl >= 0 {
+		data = data[:nl]
+	}
+	return strings.TrimSuffix(data, "\r")
 }
 
 // for multi-line text comments lets remove the Indent
@@ -308,44 +999,65 @@ findIndent:
 	return strings.Join(lines, "\n")
 }
 
-func replaceEscapes(s string) string {
-	return strings.NewReplacer(
-		"\\b", "\u0008",
-		"\\t", "\u0009",
-		"\\n", "\u000A",
-		"\\f", "\u000C",
-		"\\r", "\u000D",
-		"\\\"", "\u0022",
-		"\\/", "\u002F",
-		"\\\\", "\u005C",
-	).Replace(s)
-}
-
-func (p *parser) replaceUnicode(s string) string {
-	indexEsc := func() int {
-		return strings.Index(s, "\\u")
-	}
-	for i := indexEsc(); i != -1; i = indexEsc() {
-		asciiBytes := s[i+2 : i+6]
-		s = strings.Replace(s, s[i:i+6], p.asciiEscapeToUnicode(asciiBytes), -1)
-	}
-	return s
+// escapes are the characters that escape sequences of a single character
+// stand for.
+var escapes = map[byte]rune{
+	'b':  '\b',
+	't':  '\t',
+	'n':  '\n',
+	'f':  '\f',
+	'r':  '\r',
+	'"':  '"',
+	'/':  '/',
+	'\\': '\\',
 }
 
-func (p *parser) asciiEscapeToUnicode(s string) string {
-	hex, err := strconv.ParseUint(strings.ToLower(s), 16, 32)
-	if err != nil {
-		p.bug("Could not parse '%s' as a hexadecimal number, but the "+
-			"lexer claims it's OK: %s", s, err)
+// unescape replaces the escape sequences in a string, which the lexer has
+// already checked, with the characters they stand for. As in JSON, `\uXXXX`
+// is a UTF-16 code unit, so characters outside of the Basic Multilingual
+// Plane are written as a surrogate pair, e.g. `\ud83d\ude00`. `\xXX` is the
+// character U+00XX.
+func unescape(s string) (string, error) {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s, nil
 	}
-
-	// BUG(burntsushi)
-	// I honestly don't understand how this works. I can't seem
-	// to find a way to make this fail. I figured this would fail on invalid
-	// UTF-8 characters like U+DCFF, but it doesn't.
-	r := string(rune(hex))
-	if !utf8.ValidString(r) {
-		p.panicf("Escaped character '\\u%s' is not valid UTF-8.", s)
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 >= len(s) {
+			buf.WriteByte(s[i])
+			continue
+		}
+		i++
+		if r, ok := escapes[s[i]]; ok {
+			buf.WriteRune(r)
+			continue
+		}
+		digits := 2
+		if s[i] == 'u' {
+			digits = 4
+		}
+		if i+digits >= len(s) {
+			return "", fmt.Errorf("incomplete escape '\\%s'", s[i:])
+		}
+		code, err := strconv.ParseUint(s[i+1:i+1+digits], 16, 32)
+		if err != nil {
+			return "", fmt.Errorf("invalid escape '\\%s'", s[i:i+1+digits])
+		}
+		r := rune(code)
+		esc := s[i-1 : i+1+digits]
+		i += digits
+		if utf16.IsSurrogate(r) {
+			// The second half of the pair must follow.
+			if !strings.HasPrefix(s[i+1:], "\\u") || len(s) < i+7 {
+				return "", fmt.Errorf("escape '%s' is half of a surrogate pair", esc)
+			}
+			low, err := strconv.ParseUint(s[i+3:i+7], 16, 32)
+			if r = utf16.DecodeRune(r, rune(low)); err != nil || r == utf8.RuneError {
+				return "", fmt.Errorf("escapes '%s' are not a surrogate pair", s[i-5:i+7])
+			}
+			i += 6
+		}
+		buf.WriteRune(r)
 	}
-	return string(r)
+	return buf.String(), nil
 }
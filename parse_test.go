@@ -2,8 +2,13 @@ package confl
 
 import (
 	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 // Test to make sure we get what we expect.
@@ -179,3 +184,1218 @@ func TestBigSlices(t *testing.T) {
 		t.Errorf("unexpected: %s", x.Hosts[100])
 	}
 }
+
+func TestParseError(t *testing.T) {
+	data := `
+name = "app"
+db {
+	port = 99999999999999999999
+}
+`
+	_, err := Parse(data)
+	pe, ok := err.(*ParseError)
+	if !ok {
+		t.Fatalf("Expected a *ParseError, but got %T: %v", err, err)
+	}
+	ex := &ParseError{
+		Line:    4,
+		Column:  9,
+		KeyPath: Key{"db", "port"},
+		Msg:     "Integer '99999999999999999999' is out of the range.",
+		Source:  "\tport = 99999999999999999999",
+	}
+	if !reflect.DeepEqual(pe, ex) {
+		t.Fatalf("Not Equal:\nReceived: '%+v'\nExpected: '%+v'\n", pe, ex)
+	}
+	msg := "Parse error on line 4, column 9, key 'db.port': " +
+		"Integer '99999999999999999999' is out of the range.\n" +
+		"\tport = 99999999999999999999\n" +
+		"\t       ^"
+	if pe.Error() != msg {
+		t.Fatalf("Expected error message:\n%s\nbut got:\n%s", msg, pe.Error())
+	}
+}
+
+func TestParseErrorFromLexer(t *testing.T) {
+	_, err := Parse("a = 1\nrate = 1.x\n")
+	pe, ok := err.(*ParseError)
+	if !ok {
+		t.Fatalf("Expected a *ParseError, but got %T: %v", err, err)
+	}
+	if pe.Line != 2 || pe.Column != 10 || pe.KeyPath.String() != "rate" {
+		t.Fatalf("Unexpected error location: %+v", pe)
+	}
+	if pe.Source != "rate = 1.x" {
+		t.Fatalf("Unexpected source line: %q", pe.Source)
+	}
+}
+
+// Inputs that used to crash or hang the parser, most found by fuzzing
+// (see fuzz.go).
+var malformedVals = []string{
+	"0 (\n)x",
+	"0 (\n",
+	`title = "`,
+	"title = 'abc",
+	"foo {\n  h",
+	"foo {\n  'h",
+	"foo {\n  \"h",
+	"\"foo",
+	"'foo",
+	"array [\n  { a",
+	"table [\n  [ 1, 123 ],\n  [ \"",
+	"-plugins +l [a]\n-legacy\n6nset x\n.h ^= 1\n",
+}
+
+func TestParseMalformed(t *testing.T) {
+	opts := DecodeOptions{CollectErrors: true, DottedKeys: true, DuplicateKeys: DuplicateDeepMerge, Dialect: OverlayDialect()}
+	for _, v := range malformedVals {
+		if _, err := Parse(v); err == nil {
+			t.Errorf("Expected error for %q", v)
+		} else if _, ok := err.(*ParseError); !ok {
+			t.Errorf("Expected a *ParseError for %q, but got %T", v, err)
+		}
+		// Carrying on after errors must not lose track of the keys.
+		_, err := ParseWithOptions(v, opts)
+		errs, ok := err.(ErrorList)
+		if !ok {
+			t.Errorf("Expected an ErrorList for %q, but got %v", v, err)
+			continue
+		}
+		for _, pe := range errs {
+			if strings.Contains(pe.Msg, "BUG") {
+				t.Errorf("Unexpected error for %q: %s", v, pe)
+			}
+		}
+	}
+}
+
+func TestParseEmptyBlock(t *testing.T) {
+	test(t, "text (\n)\n", map[string]interface{}{"text": ""})
+}
+
+// TestParseTruncatedExamples feeds every prefix of the example configs,
+// the same seed corpus fuzz.go uses, through the decoder. None of them may
+// panic or hang.
+func TestParseTruncatedExamples(t *testing.T) {
+	files, err := filepath.Glob("_examples/*.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	corpus := []string{sample1, cluster, sample3, sample4, sample5, "!  "}
+	for _, f := range files {
+		bs, err := ioutil.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		corpus = append(corpus, string(bs))
+	}
+	for _, data := range corpus {
+		for i := range data {
+			var v map[string]interface{}
+			Unmarshal([]byte(data[:i]), &v)
+		}
+	}
+}
+
+var manyErrors = `
+a = 1.x
+b = 2
+db {
+  port = 1.y
+  host = ok
+}
+list = [ 1, 2.z ]
+c = 3
+`
+
+func TestParseAll(t *testing.T) {
+	m, err := ParseAll(manyErrors)
+	errs, ok := err.(ErrorList)
+	if !ok {
+		t.Fatalf("Expected an ErrorList, but got %T: %v", err, err)
+	}
+	locations := []string{"2:7 a", "5:12 db.port", "8:15 list"}
+	if len(errs) != len(locations) {
+		t.Fatalf("Expected %d errors, but got %d: %v", len(locations), len(errs), err)
+	}
+	for i, pe := range errs {
+		got := fmt.Sprintf("%d:%d %s", pe.Line, pe.Column, pe.KeyPath)
+		if got != locations[i] {
+			t.Errorf("Expected error at %s, but got %s", locations[i], got)
+		}
+	}
+
+	// Everything else is still parsed.
+	ex := map[string]interface{}{
+		"b":    int64(2),
+		"db":   map[string]interface{}{"host": "ok"},
+		"list": []interface{}{int64(1)},
+		"c":    int64(3),
+	}
+	if !reflect.DeepEqual(m, ex) {
+		t.Fatalf("Not Equal:\nReceived: '%+v'\nExpected: '%+v'\n", m, ex)
+	}
+
+	// Without errors, ParseAll is just Parse.
+	if _, err := ParseAll(sample1); err != nil {
+		t.Fatalf("Received err: %v\n", err)
+	}
+}
+
+func TestParseAllUnterminated(t *testing.T) {
+	_, err := ParseAll("a {\n  b = 1x.\n  c = \"d\n")
+	errs, ok := err.(ErrorList)
+	if !ok || len(errs) != 2 {
+		t.Fatalf("Expected 2 errors, but got %v", err)
+	}
+}
+
+var variables = `
+host = localhost
+port = 4222
+tls { verify = true }
+server {
+  port = $port
+  addr = ${host}
+  url = "nats://${host}:${port}/x"
+  tls = $tls
+  peers = [$server.addr, "${server.addr}:${backup.port}"]
+  raw = '${host}'
+  escaped = "$${host}"
+}
+backup {
+  port = 4223
+  url = "nats://${host}:${port}"
+}
+`
+
+func TestParseVariables(t *testing.T) {
+	test(t, variables, map[string]interface{}{
+		"host": "localhost",
+		"port": int64(4222),
+		"tls":  map[string]interface{}{"verify": true},
+		"server": map[string]interface{}{
+			"port":    int64(4222),
+			"addr":    "localhost",
+			"url":     "nats://localhost:4222/x",
+			"tls":     map[string]interface{}{"verify": true},
+			"peers":   []interface{}{"localhost", "localhost:4223"},
+			"raw":     "${host}",
+			"escaped": "${host}",
+		},
+		"backup": map[string]interface{}{
+			"port": int64(4223),
+			// The innermost port wins.
+			"url": "nats://localhost:4223",
+		},
+	})
+
+	// Shell snippets keep their variables in blocks, or when escaped.
+	test(t, "host = localhost\npath = \"$${HOME}/bin:${host}\"\nscript (\n  echo ${HOME} ${host}\n)\nprice = \"${5\"", map[string]interface{}{
+		"host":   "localhost",
+		"path":   "${HOME}/bin:localhost",
+		"script": "  echo ${HOME} ${host}",
+		"price":  "${5",
+	})
+}
+
+func TestParseVariableErrors(t *testing.T) {
+	tests := []struct {
+		data     string
+		location string
+		msg      string
+	}{
+		{"a = 1\nb = $c", "2:5 b", "Undefined variable 'c'."},
+		{"a {\n  url = \"http://${host}/\"\n}", "2:17 a.url", "Undefined variable 'host'."},
+		{"a = $b\nb = $c\nc = $a", "1:5 a", "Reference cycle: a -> b -> c -> a."},
+		{"a {\n  b = $a\n}", "2:7 a.b", "Reference cycle: a.b -> a.b."},
+		{"a = [1]\nb = \"${a}\"", "2:6 b", "Cannot use the value of 'a' in a string."},
+	}
+	for _, test := range tests {
+		_, err := Parse(test.data)
+		pe, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("Expected a ParseError for %q, but got %T: %v", test.data, err, err)
+			continue
+		}
+		location := fmt.Sprintf("%d:%d %s", pe.Line, pe.Column, pe.KeyPath)
+		if location != test.location || pe.Msg != test.msg {
+			t.Errorf("Expected %s: %s\nbut got %s: %s", test.location, test.msg, location, pe.Msg)
+		}
+	}
+}
+
+func TestParseDatetimes(t *testing.T) {
+	test(t, `
+zulu = 1979-05-27T07:32:00Z
+offset = 1979-05-27T07:32:00.25+02:00
+date = 2024-01-31
+tod = 07:30:00
+`, map[string]interface{}{
+		"zulu":   time.Date(1979, 5, 27, 7, 32, 0, 0, time.UTC),
+		"offset": time.Date(1979, 5, 27, 7, 32, 0, 250000000, time.FixedZone("", 2*60*60)),
+		"date":   Date{2024, time.January, 31},
+		"tod":    TimeOfDay{7, 30, 0, 0},
+	})
+
+	for _, data := range []string{
+		"a = 1979-05-27T07:32:00",
+		"a = 1979-05-27T07:32",
+		"a = 1979-5-27",
+		"a = 2024-02-30",
+		"a = 7:30:00",
+		"a = 25:00:00",
+		"a = 07:30:00.",
+	} {
+		if _, err := Parse(data); err == nil {
+			t.Errorf("Expected an error for %q", data)
+		}
+	}
+}
+
+func TestParseDurations(t *testing.T) {
+	test(t, "timeout = 30s\nttl = 1h30m\nfast = [1.5ms, -2us]", map[string]interface{}{
+		"timeout": 30 * time.Second,
+		"ttl":     90 * time.Minute,
+		"fast":    []interface{}{1500 * time.Microsecond, -2 * time.Microsecond},
+	})
+	for _, data := range []string{"a = 30x", "a = 1hm", "a = 10mm", "a = 1.s"} {
+		if _, err := Parse(data); err == nil {
+			t.Errorf("Expected an error for %q", data)
+		}
+	}
+}
+
+func TestParseNumbers(t *testing.T) {
+	m, err := Parse(`
+mask = 0xff
+perm = 0o644
+flags = -0b1010
+big = 1_000_000
+leading = 0644
+eps = 1e-9
+avogadro = 6.022E+23
+sep = 1_000.000_5
+limit = inf
+low = -inf
+`)
+	if err != nil {
+		t.Fatalf("Received err: %v\n", err)
+	}
+	ex := map[string]interface{}{
+		"mask":     int64(255),
+		"perm":     int64(0644),
+		"flags":    int64(-10),
+		"big":      int64(1000000),
+		"leading":  int64(644),
+		"eps":      1e-9,
+		"avogadro": 6.022e23,
+		"sep":      1000.0005,
+		"limit":    math.Inf(1),
+		"low":      math.Inf(-1),
+	}
+	if !reflect.DeepEqual(m, ex) {
+		t.Fatalf("Not Equal:\nReceived: '%+v'\nExpected: '%+v'\n", m, ex)
+	}
+	m, err = Parse("n = nan")
+	if f, ok := m["n"].(float64); err != nil || !ok || !math.IsNaN(f) {
+		t.Fatalf("Expected NaN, but got %v (%v)", m["n"], err)
+	}
+
+	errors := map[string]string{
+		"a = 0x8000000000000000": "Integer '0x8000000000000000' is out of the range.",
+		"a = 1e999":              "Float '1e999' is out of the range.",
+		"a = 1__0":               "Underscores in numbers must be between digits.",
+		"a = 1_":                 "Underscores in numbers must be between digits.",
+		"a = 0x":                 "Expected a digit after the base prefix, but got '\x00'.",
+		"a = 0o8":                "Expected a digit after the base prefix, but got '8'.",
+		"a = 1e":                 "Expected a digit in the exponent of a float, but got '\x00' instead.",
+	}
+	for data, msg := range errors {
+		_, err := Parse(data)
+		pe, ok := err.(*ParseError)
+		if !ok || pe.Msg != msg {
+			t.Errorf("Expected error %q for %q, but got %v", msg, data, err)
+		}
+	}
+}
+
+func TestParseSizes(t *testing.T) {
+	test(t, "a = [1k, 1kb, 1KiB, 64MB, 2GiB, 3g, 1_000K, 5M, 1t]", map[string]interface{}{
+		"a": []interface{}{
+			int64(1000), int64(1024), int64(1024), int64(64 << 20), int64(2 << 30),
+			int64(3e9), int64(1e6), int64(5e6), int64(1e12),
+		},
+	})
+	_, err := Parse("a = 9000000TB")
+	if pe, ok := err.(*ParseError); !ok || pe.Msg != "Integer '9000000TB' is out of the range." {
+		t.Fatalf("Expected a range error, but got %v", err)
+	}
+}
+
+func TestParseNull(t *testing.T) {
+	test(t, "a = null\nb = [1, nil]\nc { d: null }\ne = $a", map[string]interface{}{
+		"a": nil,
+		"b": []interface{}{int64(1), nil},
+		"c": map[string]interface{}{"d": nil},
+		"e": nil,
+	})
+}
+
+func TestParseBlockComments(t *testing.T) {
+	test(t, `
+/* a = 1
+   /* nested = 2 */
+   b = 3 */
+c /* between */ = 4
+d {
+  /* e = 5 */
+  f: /* 6 */ 7, /* g = 8 */
+  h = [9, /* 10, */ 11 /* , 12 */] /*
+  i = 13 */
+}
+path = /usr/local/bin
+`, map[string]interface{}{
+		"c": int64(4),
+		"d": map[string]interface{}{
+			"f": int64(7),
+			"h": []interface{}{int64(9), int64(11)},
+		},
+		"path": "/usr/local/bin",
+	})
+
+	_, err := Parse("a = 1\nb = 2 /* not /* closed */\nc = 3\n")
+	pe, ok := err.(*ParseError)
+	if !ok || pe.Line != 2 || pe.Column != 7 || pe.Msg != "Unterminated block comment, expected '*/'." {
+		t.Fatalf("Expected an unterminated comment error at 2:7, but got %v", err)
+	}
+}
+
+func TestParseDottedKeys(t *testing.T) {
+	data := `
+db.primary.host = localhost
+db {
+  primary { port = 5432 }
+  replica.host = replica
+}
+db.primary.tls.enabled = true
+"db.name" = literal
+db { 'primary.user' = admin }
+`
+	// Without the option, dotted keys are used as written.
+	m, err := Parse(data)
+	if err != nil {
+		t.Fatalf("Received err: %v\n", err)
+	}
+	if m["db.primary.host"] != "localhost" {
+		t.Fatalf("Expected a literal dotted key, but got %v", m)
+	}
+
+	p, err := parse(data, DecodeOptions{DottedKeys: true})
+	if err != nil {
+		t.Fatalf("Received err: %v\n", err)
+	}
+	ex := map[string]interface{}{
+		"db": map[string]interface{}{
+			"primary": map[string]interface{}{
+				"host": "localhost",
+				"port": int64(5432),
+				"tls":  map[string]interface{}{"enabled": true},
+			},
+			"replica":      map[string]interface{}{"host": "replica"},
+			"primary.user": "admin",
+		},
+		"db.name": "literal",
+	}
+	if !reflect.DeepEqual(p.mapping, ex) {
+		t.Fatalf("Not Equal:\nReceived: '%+v'\nExpected: '%+v'\n", p.mapping, ex)
+	}
+	if p.types["db.primary.tls"] != confHash || p.types["db.primary.tls.enabled"] != confBool {
+		t.Fatalf("Unexpected types: %v", p.types)
+	}
+}
+
+func TestParseDottedKeyErrors(t *testing.T) {
+	tests := []struct {
+		data string
+		pos  string
+		msg  string
+	}{
+		{"a = 1\na.b = 2", "2:1", "Key 'a' is already defined, and is not a hash."},
+		{"a.b = 1\na = 2", "2:1", "Key 'a' is already defined as a hash."},
+		{"a.b = 1\na {\n  b { c = 2 }\n}", "3:3", "Key 'a.b' is already defined, and is not a hash."},
+		{"a { b = 1 }\na = [2]", "2:1", "Key 'a' is already defined as a hash."},
+		{"a..b = 1", "1:1", "Invalid dotted key 'a..b'."},
+	}
+	for _, test := range tests {
+		_, err := parse(test.data, DecodeOptions{DottedKeys: true})
+		pe, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("Expected a ParseError for %q, but got %v", test.data, err)
+			continue
+		}
+		if pos := fmt.Sprintf("%d:%d", pe.Line, pe.Column); pos != test.pos || pe.Msg != test.msg {
+			t.Errorf("Expected %s %s for %q, but got %s %s", test.pos, test.msg, test.data, pos, pe.Msg)
+		}
+	}
+
+	// Errors inside dotted keys can still be collected.
+	p, err := parse("a.b = 1\na = 2\nc = 3\nc.d { e = [4] }\n.f = 5\ng.h = 6",
+		DecodeOptions{DottedKeys: true, CollectErrors: true})
+	if el, ok := err.(ErrorList); !ok || len(el) != 3 {
+		t.Fatalf("Expected 3 errors, but got %v", err)
+	}
+	ex := map[string]interface{}{
+		"a": map[string]interface{}{"b": int64(1)},
+		"c": int64(3),
+		"g": map[string]interface{}{"h": int64(6)},
+	}
+	if !reflect.DeepEqual(p.mapping, ex) {
+		t.Fatalf("Not Equal:\nReceived: '%+v'\nExpected: '%+v'\n", p.mapping, ex)
+	}
+}
+
+func TestParseDuplicateKeys(t *testing.T) {
+	data := `
+a = 1
+server { host = "x", tls { on = true } }
+a = 2
+server { port = 80, tls { cert = c } }
+`
+	tests := []struct {
+		dup DuplicateKeys
+		ex  map[string]interface{}
+	}{
+		{DuplicateLastWins, map[string]interface{}{
+			"a":      int64(2),
+			"server": map[string]interface{}{"port": int64(80), "tls": map[string]interface{}{"cert": "c"}},
+		}},
+		{DuplicateDeepMerge, map[string]interface{}{
+			"a": int64(2),
+			"server": map[string]interface{}{
+				"host": "x",
+				"port": int64(80),
+				"tls":  map[string]interface{}{"on": true, "cert": "c"},
+			},
+		}},
+		{DuplicateImplicitArray, map[string]interface{}{
+			"a": []interface{}{int64(1), int64(2)},
+			"server": []interface{}{
+				map[string]interface{}{"host": "x", "tls": map[string]interface{}{"on": true}},
+				map[string]interface{}{"port": int64(80), "tls": map[string]interface{}{"cert": "c"}},
+			},
+		}},
+	}
+	for _, test := range tests {
+		p, err := parse(data, DecodeOptions{DuplicateKeys: test.dup})
+		if err != nil {
+			t.Fatalf("Received err for %s: %v\n", test.dup, err)
+		}
+		if !reflect.DeepEqual(p.mapping, test.ex) {
+			t.Fatalf("Not Equal for %s:\nReceived: '%+v'\nExpected: '%+v'\n", test.dup, p.mapping, test.ex)
+		}
+	}
+
+	// Values are only collected into an array once.
+	p, err := parse("a = [1]\na = 2\na = 3", DecodeOptions{DuplicateKeys: DuplicateImplicitArray})
+	if err != nil {
+		t.Fatalf("Received err: %v\n", err)
+	}
+	if ex := []interface{}{[]interface{}{int64(1)}, int64(2), int64(3)}; !reflect.DeepEqual(p.mapping["a"], ex) {
+		t.Fatalf("Expected %v, but got %v", ex, p.mapping["a"])
+	}
+
+	// A deleted key starts again.
+	for data, ex := range map[string]interface{}{
+		"a = 1\na = 2\n-a\na = 4":       int64(4),
+		"a = 1\n-a\na = 2":              int64(2),
+		"a = 1\n-a\na = 2\na = 3":       []interface{}{int64(2), int64(3)},
+		"a = 1\na = 2\na += [3]\na = 4": []interface{}{[]interface{}{int64(1), int64(2), int64(3)}, int64(4)},
+	} {
+		p, err := parse(data, DecodeOptions{DuplicateKeys: DuplicateImplicitArray, Dialect: OverlayDialect()})
+		if err != nil {
+			t.Fatalf("Received err for %q: %v\n", data, err)
+		}
+		if !reflect.DeepEqual(p.mapping["a"], ex) {
+			t.Errorf("Expected %v for %q, but got %v", ex, data, p.mapping["a"])
+		}
+	}
+
+	_, err = parse(data, DecodeOptions{DuplicateKeys: DuplicateError})
+	pe, ok := err.(*ParseError)
+	if !ok || pe.Line != 4 || pe.Column != 1 || pe.Msg != "Key 'a' is already defined on line 2, column 1." {
+		t.Fatalf("Expected a duplicate key error, but got %v", err)
+	}
+	_, err = parse("a { b = 1 }\na {\n  b = 2\n}", DecodeOptions{DuplicateKeys: DuplicateError})
+	pe, ok = err.(*ParseError)
+	if !ok || pe.Line != 2 || pe.Msg != "Key 'a' is already defined on line 1, column 1." {
+		t.Fatalf("Expected a duplicate key error, but got %v", err)
+	}
+}
+
+func TestParseDuplicateDottedKeys(t *testing.T) {
+	opts := DecodeOptions{DottedKeys: true, DuplicateKeys: DuplicateError}
+	p, err := parse("db.host = x\ndb { port = 1 }\ndb.user = u", opts)
+	if err != nil {
+		t.Fatalf("Received err: %v\n", err)
+	}
+	ex := map[string]interface{}{
+		"db": map[string]interface{}{"host": "x", "port": int64(1), "user": "u"},
+	}
+	if !reflect.DeepEqual(p.mapping, ex) {
+		t.Fatalf("Not Equal:\nReceived: '%+v'\nExpected: '%+v'\n", p.mapping, ex)
+	}
+	for _, data := range []string{
+		"db.host = x\ndb { port = 1 }\ndb { user = u }",
+		"db.host = x\ndb.host = y",
+	} {
+		if _, err := parse(data, opts); err == nil {
+			t.Errorf("Expected a duplicate key error for %q", data)
+		}
+	}
+
+	opts.DuplicateKeys = DuplicateImplicitArray
+	p, err = parse("server.host = a\nserver { port = 1 }\nserver { host = b }", opts)
+	if err != nil {
+		t.Fatalf("Received err: %v\n", err)
+	}
+	ex = map[string]interface{}{
+		"server": []interface{}{
+			map[string]interface{}{"host": "a", "port": int64(1)},
+			map[string]interface{}{"host": "b"},
+		},
+	}
+	if !reflect.DeepEqual(p.mapping, ex) {
+		t.Fatalf("Not Equal:\nReceived: '%+v'\nExpected: '%+v'\n", p.mapping, ex)
+	}
+}
+
+func TestParseImplicitArrayNested(t *testing.T) {
+	// Keys repeated in each of the repeated blocks are collected separately.
+	p, err := parse("s { a = 1, a = 2 }\ns { a = 3, a = 4 }\ns { a = 5 }",
+		DecodeOptions{DuplicateKeys: DuplicateImplicitArray})
+	if err != nil {
+		t.Fatalf("Received err: %v\n", err)
+	}
+	ex := []interface{}{
+		map[string]interface{}{"a": []interface{}{int64(1), int64(2)}},
+		map[string]interface{}{"a": []interface{}{int64(3), int64(4)}},
+		map[string]interface{}{"a": int64(5)},
+	}
+	if !reflect.DeepEqual(p.mapping["s"], ex) {
+		t.Fatalf("Not Equal:\nReceived: '%+v'\nExpected: '%+v'\n", p.mapping["s"], ex)
+	}
+}
+
+func TestParseEscapes(t *testing.T) {
+	test(t, `a = "x\ty\nz"
+b = "\"\\\/"
+c = "café \x41"
+d = "\ud83d\ude00 \u00e9"
+e = 'raw\né'
+f = "\b\f\r"`, map[string]interface{}{
+		"a": "x\ty\nz",
+		"b": `"\/`,
+		"c": "café A",
+		"d": "😀 é",
+		"e": `raw\né`,
+		"f": "\b\f\r",
+	})
+
+	// Unquoted strings are left as written.
+	test(t, `a = C:\new\x41
+b = [\t, x\u00e9]`, map[string]interface{}{
+		"a": `C:\new\x41`,
+		"b": []interface{}{`\t`, `x\u00e9`},
+	})
+
+	for _, data := range []string{`a = "\ud83d"`, `a = "\q"`, `a = "\u12"`, `a = "\xg1"`, `a = "C:\path"`} {
+		if _, err := Parse(data); err == nil {
+			t.Errorf("Expected an error for %s", data)
+		}
+	}
+}
+
+func TestParseHeredoc(t *testing.T) {
+	test(t, "a = <<EOD\n  echo \"${HOME}\" \\n\n)\nEOD\nb {\n  c = <<-EOD\n    x\n      y\n    EOD\n}\nd = [1]", map[string]interface{}{
+		"a": "  echo \"${HOME}\" \\n\n)",
+		"b": map[string]interface{}{"c": "x\n  y"},
+		"d": []interface{}{int64(1)},
+	})
+
+	tests := []struct {
+		data string
+		pos  string
+		msg  string
+	}{
+		{"a = 1\nb = <<EOD\nx\n EOD\n", "2:5", "Unterminated heredoc, expected 'EOD' on a line by itself."},
+		{"a = <<EOD x\nEOD", "1:10", "Expected a new line after the heredoc terminator 'EOD', but got ' ' instead."},
+	}
+	for _, test := range tests {
+		_, err := Parse(test.data)
+		pe, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("Expected a ParseError for %q, but got %v", test.data, err)
+			continue
+		}
+		if pos := fmt.Sprintf("%d:%d", pe.Line, pe.Column); pos != test.pos || pe.Msg != test.msg {
+			t.Errorf("Expected %s %s for %q, but got %s %s", test.pos, test.msg, test.data, pos, pe.Msg)
+		}
+	}
+}
+
+func TestParseRoot(t *testing.T) {
+	test(t, `// comments can be added to JSON
+{
+  "name": "app",
+  "servers": [{"host": "a"}, {"host": "b"}],
+  "db": {"port": 5432}
+}`, map[string]interface{}{
+		"name": "app",
+		"servers": []interface{}{
+			map[string]interface{}{"host": "a"},
+			map[string]interface{}{"host": "b"},
+		},
+		"db": map[string]interface{}{"port": int64(5432)},
+	})
+	test(t, "{}", map[string]interface{}{})
+
+	// Unquoted values in an object end at a ',' or '}'.
+	test(t, `{"a": true, "b": {"c": false}, "d": null}`, map[string]interface{}{
+		"a": true,
+		"b": map[string]interface{}{"c": false},
+		"d": nil,
+	})
+	test(t, `{
+  "enabled": true,
+  "db": {
+    "tls": false
+  },
+  "password": null,
+  "port": 80
+}`, map[string]interface{}{
+		"enabled":  true,
+		"db":       map[string]interface{}{"tls": false},
+		"password": nil,
+		"port":     int64(80),
+	})
+	// Elsewhere, they are part of the value.
+	test(t, "x {\n  a = foo,bar\n  url = http://h/a,b\n  b = b}c\n  c = 2\n}", map[string]interface{}{
+		"x": map[string]interface{}{
+			"a":   "foo,bar",
+			"url": "http://h/a,b",
+			"b":   "b}c",
+			"c":   int64(2),
+		},
+	})
+
+	tests := []struct {
+		data string
+		pos  string
+		msg  string
+	}{
+		{"{\n  \"a\": 1\n}\nb = 2", "4:1", "Expected the end of the input after its top-level object or array, but got 'b' instead."},
+		{"[1, 2]\n[3]", "2:1", "Expected the end of the input after its top-level object or array, but got '[' instead."},
+	}
+	for _, test := range tests {
+		_, err := Parse(test.data)
+		pe, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("Expected a ParseError for %q, but got %v", test.data, err)
+			continue
+		}
+		if pos := fmt.Sprintf("%d:%d", pe.Line, pe.Column); pos != test.pos || pe.Msg != test.msg {
+			t.Errorf("Expected %s %s for %q, but got %s %s", test.pos, test.msg, test.data, pos, pe.Msg)
+		}
+	}
+
+	if _, err := Parse(`[1, 2]`); err != errArrayRoot {
+		t.Errorf("Expected an error for an array, but got %v", err)
+	}
+}
+
+func TestParseDialect(t *testing.T) {
+	p, err := parse(`{"a": [1, "x", true, null], "b": {"c": 1.5, "d": false, "e": null}, "f": true}`, DecodeOptions{Dialect: JSONDialect()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex := map[string]interface{}{
+		"a": []interface{}{int64(1), "x", true, nil},
+		"b": map[string]interface{}{"c": 1.5, "d": false, "e": nil},
+		"f": true,
+	}
+	if !reflect.DeepEqual(p.mapping, ex) {
+		t.Fatalf("Not Equal:\nReceived: '%+v'\nExpected: '%+v'\n", p.mapping, ex)
+	}
+
+	hashOnly := DefaultDialect()
+	hashOnly.Comments = HashComments
+	equalOnly := DefaultDialect()
+	equalOnly.Separators = SeparatorEqual
+	at := DefaultDialect()
+	at.IdentifierChars = "_.@"
+
+	tests := []struct {
+		dialect Dialect
+		data    string
+		pos     string
+		msg     string
+	}{
+		{JSONDialect(), `"a": 1`, "1:1", "Expected an object or array, but got '\"' instead."},
+		{JSONDialect(), `{a: 1}`, "1:2", "Expected a quoted key, but got 'a' instead."},
+		{JSONDialect(), `{"a" = 1}`, "1:6", "The key separator '=' is not allowed."},
+		{JSONDialect(), `{"a" 1}`, "1:6", "Expected a key separator, but got '1' instead."},
+		{JSONDialect(), "{\"a\": x\n}", "1:7", "Expected a double-quoted string, but got 'x' instead."},
+		{JSONDialect(), `["a", 'b']`, "1:7", "Expected a double-quoted string, but got ''' instead."},
+		{JSONDialect(), `{"a": $b}`, "1:7", "Expected a double-quoted string, but got '$' instead."},
+		{JSONDialect(), "{\"a\": 1} // one", "1:10", "Comments starting with '//' are not allowed."},
+		{JSONDialect(), "/* one */ [1]", "1:1", "Comments starting with '/*' are not allowed."},
+		{hashOnly, "a = 1 // one", "1:7", "Comments starting with '//' are not allowed."},
+		{equalOnly, "a: 1", "1:2", "The key separator ':' is not allowed."},
+		{equalOnly, "a {\n  b 1\n}", "1:3", "Expected a key separator, but got '{' instead."},
+	}
+	for _, test := range tests {
+		_, err := parse(test.data, DecodeOptions{Dialect: test.dialect})
+		pe, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("Expected a ParseError for %q, but got %v", test.data, err)
+			continue
+		}
+		if pos := fmt.Sprintf("%d:%d", pe.Line, pe.Column); pos != test.pos || pe.Msg != test.msg {
+			t.Errorf("Expected %s %s for %q, but got %s %s", test.pos, test.msg, test.data, pos, pe.Msg)
+		}
+	}
+
+	m, err := ParseWithOptions("@a = 1\nb = $@a # one", DecodeOptions{Dialect: at})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex = map[string]interface{}{"@a": int64(1), "b": int64(1)}
+	if !reflect.DeepEqual(m, ex) {
+		t.Fatalf("Not Equal:\nReceived: '%+v'\nExpected: '%+v'\n", m, ex)
+	}
+}
+
+func TestParseTables(t *testing.T) {
+	test(t, `
+title = "TOML"
+
+[db.primary]
+host = "localhost"
+ports = [8001, 8002]
+
+[db]
+name = main
+
+[[servers]]
+name = a
+
+[[servers]]
+name = b
+
+[servers.tls]
+cert = "b.pem"
+
+["quoted.key".x]
+y = 1
+`, map[string]interface{}{
+		"title": "TOML",
+		"db": map[string]interface{}{
+			"name": "main",
+			"primary": map[string]interface{}{
+				"host":  "localhost",
+				"ports": []interface{}{int64(8001), int64(8002)},
+			},
+		},
+		"servers": []interface{}{
+			map[string]interface{}{"name": "a"},
+			map[string]interface{}{
+				"name": "b",
+				"tls":  map[string]interface{}{"cert": "b.pem"},
+			},
+		},
+		"quoted.key": map[string]interface{}{
+			"x": map[string]interface{}{"y": int64(1)},
+		},
+	})
+
+	// A document may start with a header rather than be an array.
+	test(t, "[a]\nb = 1", map[string]interface{}{
+		"a": map[string]interface{}{"b": int64(1)},
+	})
+	test(t, "[\"a.b\"]\nx = 1\n[2024]\ny = 2\n[[ 'c' . d ]]\nz = 3", map[string]interface{}{
+		"a.b":  map[string]interface{}{"x": int64(1)},
+		"2024": map[string]interface{}{"y": int64(2)},
+		"c":    map[string]interface{}{"d": []interface{}{map[string]interface{}{"z": int64(3)}}},
+	})
+	test(t, "[2024] # year\nx = 1", map[string]interface{}{
+		"2024": map[string]interface{}{"x": int64(1)},
+	})
+	for _, data := range []string{`["a]b", 1]`, `[{"a": 1}]`, "[a,b]\n"} {
+		if _, err := Parse(data); err != errArrayRoot {
+			t.Errorf("Expected an error for an array in %q, but got %v", data, err)
+		}
+	}
+
+	tests := []struct {
+		data string
+		pos  string
+		msg  string
+	}{
+		{"[a]\nb = 1\n[a]", "3:2", "Table 'a' is already defined on line 1, column 2."},
+		{"a { b = 1 }\n[a]", "2:2", "Table 'a' is already defined on line 1, column 1."},
+		{"a = 1\n[a.b]", "2:2", "Key 'a' is already defined, and is not a table."},
+		{"[a]\n[[a]]", "2:3", "Key 'a' is already defined, and is not an array of tables."},
+		{"[[a]]\n[a]", "2:2", "Key 'a' is already defined, and is not a table."},
+		{"x = 1\n[a..b]", "2:2", "Invalid table name 'a..b': expected a key."},
+		{"x = 1\n[a", "2:3", "Unterminated table header, expected ']'."},
+		{"x = 1\n[[a]", "2:4", "Expected ']]' to end the table header."},
+	}
+	for _, test := range tests {
+		_, err := Parse(test.data)
+		pe, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("Expected a ParseError for %q, but got %v", test.data, err)
+			continue
+		}
+		if pos := fmt.Sprintf("%d:%d", pe.Line, pe.Column); pos != test.pos || pe.Msg != test.msg {
+			t.Errorf("Expected %s %s for %q, but got %s %s", test.pos, test.msg, test.data, pos, pe.Msg)
+		}
+	}
+
+	// The keys of a redefined table are still checked, but thrown away.
+	m, err := ParseAll("[a]\nb = 1\n[a]\nc = 1 2\n[d]\ne = 2")
+	if el, ok := err.(ErrorList); !ok || len(el) != 2 {
+		t.Fatalf("Expected 2 errors, but got %v", err)
+	}
+	ex := map[string]interface{}{
+		"a": map[string]interface{}{"b": int64(1)},
+		"d": map[string]interface{}{"e": int64(2)},
+	}
+	if !reflect.DeepEqual(m, ex) {
+		t.Fatalf("Not Equal:\nReceived: '%+v'\nExpected: '%+v'\n", m, ex)
+	}
+}
+
+func TestParseLabels(t *testing.T) {
+	test(t, `
+backend "s3" "primary" { bucket = a }
+backend "s3" "backup" { bucket = b }
+backend 'gcs' {
+  bucket = c
+}
+server {
+  listener "http" { port = 80 }
+}`, map[string]interface{}{
+		"backend": map[string]interface{}{
+			"s3": map[string]interface{}{
+				"primary": map[string]interface{}{"bucket": "a"},
+				"backup":  map[string]interface{}{"bucket": "b"},
+			},
+			"gcs": map[string]interface{}{"bucket": "c"},
+		},
+		"server": map[string]interface{}{
+			"listener": map[string]interface{}{
+				"http": map[string]interface{}{"port": int64(80)},
+			},
+		},
+	})
+
+	_, err := Parse("backend = 1\nbackend \"s3\" { bucket = a }")
+	pe, ok := err.(*ParseError)
+	if !ok || pe.Line != 2 || pe.Msg != "Key 'backend' is already defined, and is not a hash." {
+		t.Fatalf("Expected an error for a label on a value, but got %v", err)
+	}
+
+	// Blocks with the same labels are merged, whatever is done with
+	// duplicate keys.
+	data := "server \"api\" { port = 1 }\nserver \"api\" { host = h }\nbackend \"s3\" \"a\" { x = 1 }\nbackend \"s3\" \"a\" { y = 2 }"
+	ex := map[string]interface{}{
+		"server":  map[string]interface{}{"api": map[string]interface{}{"port": int64(1), "host": "h"}},
+		"backend": map[string]interface{}{"s3": map[string]interface{}{"a": map[string]interface{}{"x": int64(1), "y": int64(2)}}},
+	}
+	for dup := DuplicateLastWins; dup <= DuplicateImplicitArray; dup++ {
+		p, err := parse(data, DecodeOptions{DuplicateKeys: dup})
+		if err != nil {
+			t.Fatalf("Received err for %s: %v", dup, err)
+		}
+		if !reflect.DeepEqual(p.mapping, ex) {
+			t.Fatalf("Not Equal for %s:\nReceived: '%+v'\nExpected: '%+v'\n", dup, p.mapping, ex)
+		}
+	}
+	_, err = parse("server \"api\" { port = 1 }\nserver \"api\" { port = 2 }", DecodeOptions{DuplicateKeys: DuplicateError})
+	pe, ok = err.(*ParseError)
+	if !ok || pe.Line != 2 || pe.Msg != "Key 'server.api.port' is already defined on line 1, column 16." {
+		t.Fatalf("Expected a duplicate key error, but got %v", err)
+	}
+
+	// The labels and block of a key with an error are skipped.
+	m, err := ParseWithOptions("a. \"x\" \"y\" { b = 1 }\nc = 2", DecodeOptions{DottedKeys: true, CollectErrors: true})
+	if el, ok := err.(ErrorList); !ok || len(el) != 1 || el[0].Msg != "Invalid dotted key 'a.'." {
+		t.Fatalf("Expected an error for the key, but got %v", err)
+	}
+	if ex := map[string]interface{}{"c": int64(2)}; !reflect.DeepEqual(m, ex) {
+		t.Fatalf("Not Equal:\nReceived: '%+v'\nExpected: '%+v'\n", m, ex)
+	}
+}
+
+func TestParseDirectives(t *testing.T) {
+	p, err := parse(`
+worker_processes 4;
+listen 80 default_server;
+listen 443 ssl;
+server {
+  root /var/www  # the site
+  gzip
+  server_name a.example.com "b example";
+}
+port = 8080
+`, DecodeOptions{Dialect: NginxDialect()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex := map[string]interface{}{
+		"worker_processes": int64(4),
+		"listen": []interface{}{
+			[]interface{}{int64(80), "default_server"},
+			[]interface{}{int64(443), "ssl"},
+		},
+		"server": map[string]interface{}{
+			"root":        "/var/www",
+			"gzip":        true,
+			"server_name": []interface{}{"a.example.com", "b example"},
+		},
+		"port": int64(8080),
+	}
+	if !reflect.DeepEqual(p.mapping, ex) {
+		t.Fatalf("Not Equal:\nReceived: '%+v'\nExpected: '%+v'\n", p.mapping, ex)
+	}
+
+	// Without directives, a key still takes one value.
+	if _, err := Parse("listen 80 default_server"); err == nil {
+		t.Fatal("Expected an error for a directive in the default dialect")
+	}
+
+	// The arguments before an error are kept.
+	p, err = parse("a 1 99999999999999999999 3\nb 2", DecodeOptions{Dialect: NginxDialect(), CollectErrors: true})
+	if el, ok := err.(ErrorList); !ok || len(el) != 1 {
+		t.Fatalf("Expected 1 error, but got %v", err)
+	}
+	ex = map[string]interface{}{
+		"a": []interface{}{int64(1), int64(3)},
+		"b": int64(2),
+	}
+	if !reflect.DeepEqual(p.mapping, ex) {
+		t.Fatalf("Not Equal:\nReceived: '%+v'\nExpected: '%+v'\n", p.mapping, ex)
+	}
+
+	// Arguments in a hash end at its ',' or '}'.
+	m, err := ParseWithOptions(`{"a": [1, {"b"x null}]}`, DecodeOptions{Dialect: NginxDialect()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex = map[string]interface{}{
+		"a": []interface{}{int64(1), map[string]interface{}{"b": []interface{}{"x", nil}}},
+	}
+	if !reflect.DeepEqual(m, ex) {
+		t.Fatalf("Not Equal:\nReceived: '%+v'\nExpected: '%+v'\n", m, ex)
+	}
+
+	tests := []struct {
+		data string
+		pos  string
+		msg  string
+	}{
+		{`{"a": [{"b" x ]}]}`, "1:15", "Expected an argument or the end of a directive, but got ']' instead."},
+		{"a {\n  b x ]\n}", "2:7", "Expected an argument or the end of a directive, but got ']' instead."},
+	}
+	for _, test := range tests {
+		for _, collect := range []bool{false, true} {
+			_, err := parse(test.data, DecodeOptions{Dialect: NginxDialect(), CollectErrors: collect})
+			if el, ok := err.(ErrorList); ok {
+				err = el[0]
+			}
+			pe, ok := err.(*ParseError)
+			if !ok {
+				t.Errorf("Expected a ParseError for %q, but got %v", test.data, err)
+				continue
+			}
+			if pos := fmt.Sprintf("%d:%d", pe.Line, pe.Column); pos != test.pos || pe.Msg != test.msg {
+				t.Errorf("Expected %s %s for %q, but got %s %s", test.pos, test.msg, test.data, pos, pe.Msg)
+			}
+		}
+	}
+}
+
+func TestParseOperators(t *testing.T) {
+	overlay := DecodeOptions{Dialect: OverlayDialect()}
+	m, err := ParseWithOptions(`
+plugins += ["audit"]
+-legacy_mode
+hosts = [b]
+hosts += c
+hosts ^= [a]
+server {
+  unset tls
+  ports ^= 80
+  ports += [443]
+}
+`, overlay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex := map[string]interface{}{
+		"plugins":     Operations{{OpAppend, []interface{}{"audit"}}},
+		"legacy_mode": Operations{{Op: OpDelete}},
+		"hosts":       []interface{}{"a", "b", "c"},
+		"server": map[string]interface{}{
+			"tls":   Operations{{Op: OpDelete}},
+			"ports": Operations{{OpPrepend, int64(80)}, {OpAppend, []interface{}{int64(443)}}},
+		},
+	}
+	if !reflect.DeepEqual(m, ex) {
+		t.Fatalf("Not Equal:\nReceived: '%+v'\nExpected: '%+v'\n", m, ex)
+	}
+
+	// Without operators, unset is an ordinary key.
+	test(t, "unset foo", map[string]interface{}{"unset": "foo"})
+
+	tests := []struct {
+		data string
+		pos  string
+		msg  string
+	}{
+		{"a = 1\na += 2", "2:1", "Cannot append to 'a', which is not an array."},
+		{"b = 1\na = $b\na ^= [2]", "3:1", "Cannot prepend to 'a', which refers to another key."},
+		{"-\na = 1", "1:2", "Expected a key to delete, but got '\\n' instead."},
+	}
+	for _, test := range tests {
+		_, err := ParseWithOptions(test.data, overlay)
+		pe, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("Expected a ParseError for %q, but got %v", test.data, err)
+			continue
+		}
+		if pos := fmt.Sprintf("%d:%d", pe.Line, pe.Column); pos != test.pos || pe.Msg != test.msg {
+			t.Errorf("Expected %s %s for %q, but got %s %s", test.pos, test.msg, test.data, pos, pe.Msg)
+		}
+	}
+}
+
+func TestParseProfiles(t *testing.T) {
+	data := `
+a = 1
+db { host = "localhost", port = 5432 }
+plugins = [auth]
+@production {
+  a = $b
+  b = 2
+  db { host = "prod-db" }
+}
+@env(staging, production) {
+  plugins += [audit]
+  -a
+  c = $plugins
+  db { name = $host }
+}
+`
+	tests := []struct {
+		profiles []string
+		ex       map[string]interface{}
+	}{
+		{[]string{}, map[string]interface{}{
+			"a":       int64(1),
+			"db":      map[string]interface{}{"host": "localhost", "port": int64(5432)},
+			"plugins": []interface{}{"auth"},
+		}},
+		{[]string{"staging"}, map[string]interface{}{
+			"c":       []interface{}{"auth", "audit"},
+			"db":      map[string]interface{}{"host": "localhost", "port": int64(5432), "name": "localhost"},
+			"plugins": []interface{}{"auth", "audit"},
+		}},
+		{[]string{"production"}, map[string]interface{}{
+			"b":       int64(2),
+			"c":       []interface{}{"auth", "audit"},
+			"db":      map[string]interface{}{"host": "prod-db", "port": int64(5432), "name": "prod-db"},
+			"plugins": []interface{}{"auth", "audit"},
+		}},
+	}
+	for _, test := range tests {
+		m, err := ParseWithOptions(data, DecodeOptions{Dialect: OverlayDialect(), Profiles: test.profiles})
+		if err != nil {
+			t.Fatalf("Received err for %v: %v", test.profiles, err)
+		}
+		if !reflect.DeepEqual(m, test.ex) {
+			t.Errorf("Not Equal for %v:\nReceived: '%+v'\nExpected: '%+v'", test.profiles, m, test.ex)
+		}
+	}
+
+	errors := []struct {
+		data string
+		pos  string
+		msg  string
+	}{
+		{"@prod a = 1", "1:7", "Expected '{' to start the section of a profile, but got 'a' instead."},
+		{"@env(prod { }", "1:14", "Unterminated profile, expected ')'."},
+		{"@os(linux) { }", "1:2", "Invalid profile 'os(linux)': expected a name or env(name)."},
+		{"@env(a,,b) { }", "1:2", "Invalid profile 'env(a,,b)': expected a name."},
+		{"@env(a.b) { }", "1:2", "Invalid profile 'env(a.b)': unexpected '.' in the name 'a.b'."},
+		{"a = 1\n@prod {\n  a += [2]\n}", "2:2", "Cannot append to 'a', which is not an array."},
+	}
+	for _, test := range errors {
+		_, err := ParseWithOptions(test.data, DecodeOptions{Dialect: OverlayDialect(), Profiles: []string{"prod"}})
+		pe, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("Expected a ParseError for %q, but got %v", test.data, err)
+			continue
+		}
+		if pos := fmt.Sprintf("%d:%d", pe.Line, pe.Column); pos != test.pos || pe.Msg != test.msg {
+			t.Errorf("Expected %s %s for %q, but got %s %s", test.pos, test.msg, test.data, pos, pe.Msg)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	base, err := Parse(`
+plugins = [auth]
+legacy_mode = true
+server { host = "localhost", port = 80, tls { cert = a } }
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	overlay, err := ParseWithOptions(`
+plugins += [audit]
+-legacy_mode
+server { port = 8080, tls { -cert } }
+hosts ^= a
+`, DecodeOptions{Dialect: OverlayDialect()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged, err := Merge(base, overlay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex := map[string]interface{}{
+		"plugins": []interface{}{"auth", "audit"},
+		"server": map[string]interface{}{
+			"host": "localhost",
+			"port": int64(8080),
+			"tls":  map[string]interface{}{},
+		},
+		"hosts": []interface{}{"a"},
+	}
+	if !reflect.DeepEqual(merged, ex) {
+		t.Fatalf("Not Equal:\nReceived: '%+v'\nExpected: '%+v'\n", merged, ex)
+	}
+	if _, ok := base["legacy_mode"]; !ok {
+		t.Fatal("Expected the base to be left as it was")
+	}
+
+	_, err = Merge(map[string]interface{}{"plugins": "x"}, overlay)
+	if err == nil || err.Error() != "Cannot append to 'plugins', which is not an array." {
+		t.Fatalf("Expected an error for appending to a string, but got %v", err)
+	}
+}
@@ -0,0 +1,228 @@
+package confl
+
+import (
+	"os"
+	"reflect"
+	"strings"
+)
+
+// section is the section of the data for one or more profiles, such as
+// `@production { }`, which is merged over the rest of the data when one of
+// them is selected.
+type section struct {
+	key     Key    // the key its keys are parsed under, e.g. `@production`
+	profile string // the first of its profiles that is selected, if any
+	hash    map[string]interface{}
+
+	// The references in the section are p.refs[firstRef:lastRef].
+	firstRef int
+	lastRef  int
+
+	// Where the section starts, for errors found once it is parsed.
+	file string
+	data string
+	pos  Pos
+}
+
+// profiles returns the profiles selected by the options, or by the
+// CONFL_PROFILE environment variable.
+func (opts DecodeOptions) profiles() []string {
+	if opts.Profiles != nil {
+		return opts.Profiles
+	}
+	var profiles []string
+	for _, name := range strings.Split(os.Getenv("CONFL_PROFILE"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			profiles = append(profiles, name)
+		}
+	}
+	return profiles
+}
+
+// startSection starts the section for the profiles of it, `name` or
+// `env(name, ...)`, whose hash comes next.
+func (p *parser) startSection(it item) *ParseError {
+	if p.ctx == nil || len(p.scopes) != 1 {
+		p.skipping = true
+		return p.errorf(it.pos, "Profile sections can only be at the top level.")
+	}
+	names, err := profileNames(it.val)
+	if err != nil {
+		p.skipping = true
+		return p.errorf(it.pos, "Invalid profile '%s': %s.", it.val, err)
+	}
+	s := &section{
+		key:      Key{string(profileStart) + it.val},
+		file:     p.file(),
+		data:     p.lx.input,
+		pos:      it.pos,
+		firstRef: len(p.refs),
+	}
+	for _, selected := range p.profiles {
+		for _, name := range names {
+			if s.profile == "" && name == selected {
+				s.profile = name
+			}
+		}
+	}
+	p.section = s
+	return nil
+}
+
+// enterSection makes the hash of the section just started the context.
+func (p *parser) enterSection() {
+	s := p.section
+	p.section = nil
+	s.hash = make(map[string]interface{})
+	p.pushContext(s.hash, s.key)
+	p.scopes[len(p.scopes)-1].profile = true
+	p.sections = append(p.sections, s)
+}
+
+// leaveSection goes back to the top level at the end of a section. The
+// references in the section of a profile that isn't selected are dropped,
+// so that they aren't resolved.
+func (p *parser) leaveSection() {
+	p.popContext()
+	s := p.sections[len(p.sections)-1]
+	if s.profile == "" {
+		p.refs = p.refs[:s.firstRef]
+	}
+	s.lastRef = len(p.refs)
+}
+
+// applyProfiles merges the sections of the selected profiles over the rest
+// of the data, in the order they appear. They are merged in place, and the
+// references in them then look keys up in the merged data, so that
+// references anywhere find what the sections set.
+func (p *parser) applyProfiles() *ParseError {
+	for _, s := range p.sections {
+		if s.lastRef < s.firstRef {
+			// The section was left open by an error.
+			s.lastRef = len(p.refs)
+		}
+		if s.profile == "" {
+			continue
+		}
+		if err := mergeInto(p.mapping, s.hash, nil, false); err != nil {
+			return newParseError(s.file, s.data, s.pos, s.key, err.Error())
+		}
+		merged := make(map[uintptr]map[string]interface{})
+		mergedHashes(s.hash, p.mapping, merged)
+		for _, r := range p.refs[s.firstRef:s.lastRef] {
+			scopes := r.scopes[:0:0]
+			for _, hash := range r.scopes {
+				if m, ok := merged[hashPointer(hash)]; ok {
+					hash = m
+				}
+				if n := len(scopes); n == 0 || hashPointer(scopes[n-1]) != hashPointer(hash) {
+					scopes = append(scopes, hash)
+				}
+			}
+			r.scopes = scopes
+		}
+	}
+	return nil
+}
+
+// mergedHashes records the hash in dst that each hash in src, which was
+// merged into dst, was merged into.
+func mergedHashes(src, dst map[string]interface{}, merged map[uintptr]map[string]interface{}) {
+	merged[hashPointer(src)] = dst
+	for k, v := range src {
+		if hash, ok := v.(map[string]interface{}); ok {
+			if into, ok := dst[k].(map[string]interface{}); ok {
+				mergedHashes(hash, into, merged)
+			}
+		}
+	}
+}
+
+func hashPointer(hash map[string]interface{}) uintptr {
+	return reflect.ValueOf(hash).Pointer()
+}
+
+// moveProfileKeys moves what is known of the keys in the sections of the
+// selected profiles, which were parsed under the keys of their sections,
+// e.g. `@production.db.host`, to the keys they were merged into, and drops
+// it for other sections.
+func (p *parser) moveProfileKeys() {
+	if len(p.sections) == 0 {
+		return
+	}
+	profiles := make(map[string]string, len(p.sections))
+	for _, s := range p.sections {
+		profiles[s.key[0]] = s.profile
+	}
+
+	// Keys that are set elsewhere as well are only listed where they are
+	// first set.
+	listed := make(map[string]bool, len(p.ordered))
+	for _, key := range p.ordered {
+		if _, ok := profiles[key[0]]; !ok {
+			listed[key.String()] = true
+		}
+	}
+	ordered := p.ordered[:0]
+	for _, key := range p.ordered {
+		profile, ok := profiles[key[0]]
+		switch {
+		case !ok:
+			ordered = append(ordered, key)
+		case profile != "":
+			p.keyProfiles[key[1:].String()] = profile
+			if k := key[1:].String(); !listed[k] {
+				ordered = append(ordered, key[1:])
+				listed[k] = true
+			}
+		}
+	}
+	p.ordered = ordered
+
+	for k, typ := range p.types {
+		if i := strings.IndexByte(k, '.'); i > 0 {
+			if profile, ok := profiles[k[:i]]; ok {
+				delete(p.types, k)
+				if profile != "" {
+					p.types[k[i+1:]] = typ
+				}
+			}
+		}
+	}
+	for k, pos := range p.positions {
+		if i := strings.IndexByte(k, '.'); i > 0 {
+			if profile, ok := profiles[k[:i]]; ok {
+				delete(p.positions, k)
+				if profile != "" {
+					p.positions[k[i+1:]] = pos
+				}
+			}
+		}
+	}
+}
+
+// profileNames returns the names of the profiles of a section, written as
+// `name` or `env(name, ...)`.
+func profileNames(profiles string) ([]string, error) {
+	list := profiles
+	if i := strings.IndexByte(profiles, blockStart); i >= 0 {
+		if profiles[:i] != "env" || !strings.HasSuffix(profiles, string(blockEnd)) {
+			return nil, e("expected a name or env(name)")
+		}
+		list = profiles[i+1 : len(profiles)-1]
+	}
+	var names []string
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, e("expected a name")
+		}
+		for _, r := range name {
+			if !isIdentifierRune(r, "_-") {
+				return nil, e("unexpected '%c' in the name '%s'", r, name)
+			}
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
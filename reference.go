@@ -0,0 +1,386 @@
+package confl
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Values may refer to other keys. A whole value `$name` or `${path.to.key}`
+// takes on the referenced value, whatever its type, while `${name}` within a
+// string is replaced by the text of the referenced value:
+//
+//   host = localhost
+//   port = 4222
+//   server {
+//     port = $port
+//     url = "nats://${host}:${port}"
+//   }
+//
+// A name is looked up in each enclosing hash in turn, innermost first, so
+// the top level is searched last. Keys may be referenced before they are
+// defined, so references are resolved once parsing is done. Use `$${` for
+// a literal `${` in a string, and single quotes for strings that should be
+// left exactly as written.
+
+// reference stands in for a value referring to other keys until it is
+// resolved.
+type reference struct {
+	it     item
+	str    string                   // the string to interpolate, or "" for a whole value
+	key    Key                      // the full key of the value
+	hash   bool                     // whether the value is set in a hash, rather than an array
+	scopes []map[string]interface{} // the enclosing hashes, innermost first
+	file   string                   // the file containing the reference
+	data   string                   // the data containing the reference
+	state  refState                 // how far resolving has got
+	val    interface{}              // the value, once resolved
+}
+
+type refState int
+
+const (
+	refUnresolved refState = iota
+	refResolving
+	refResolved
+	refFailed
+)
+
+// newReference returns a reference for the variable or string item it, which
+// is about to be set in the current context.
+func (p *parser) newReference(it item, str string) *reference {
+	r := &reference{
+		it:   it,
+		str:  str,
+		key:  p.nextKey(),
+		file: p.file(),
+		data: p.lx.input,
+	}
+	_, r.hash = p.ctx.(map[string]interface{})
+	for i := len(p.ctxs) - 1; i >= 0; i-- {
+		if hash, ok := p.ctxs[i].(map[string]interface{}); ok {
+			r.scopes = append(r.scopes, hash)
+		}
+	}
+	p.refs = append(p.refs, r)
+	return r
+}
+
+func (r *reference) errorf(pos Pos, format string, v ...interface{}) *ParseError {
+	return newParseError(r.file, r.data, pos, r.key, fmt.Sprintf(format, v...))
+}
+
+// name returns the name of the key a whole value refers to.
+func (r *reference) name() string {
+	name := strings.TrimPrefix(r.it.val, string(variableStart))
+	if strings.HasPrefix(name, string(mapStart)) {
+		name = strings.TrimSuffix(name[1:], string(mapEnd))
+	}
+	return name
+}
+
+// resolveReferences replaces every reference in the parsed data with its
+// value. It returns the first problem found, unless errors are being
+// collected.
+func (p *parser) resolveReferences() *ParseError {
+	if len(p.refs) == 0 {
+		return nil
+	}
+	for _, r := range p.refs {
+		if perr := p.resolve(r); perr != nil {
+			if !p.collect {
+				return perr
+			}
+			p.errors = append(p.errors, perr)
+		}
+	}
+	p.mapping = p.replaceReferences(p.mapping).(map[string]interface{})
+	if p.root != nil {
+		p.root = p.replaceReferences(p.root)
+	}
+	return nil
+}
+
+// replaceReferences returns v with any references in it replaced by their
+// values. References that could not be resolved are left out of hashes, and
+// are nil in arrays.
+func (p *parser) replaceReferences(v interface{}) interface{} {
+	switch v := v.(type) {
+	case *reference:
+		return v.val
+	case map[string]interface{}:
+		for k, val := range v {
+			if r, ok := val.(*reference); ok && r.state != refResolved {
+				delete(v, k)
+				continue
+			}
+			v[k] = p.replaceReferences(val)
+		}
+	case []interface{}:
+		for i, val := range v {
+			v[i] = p.replaceReferences(val)
+		}
+	case Operations:
+		for i := range v {
+			v[i].Value = p.replaceReferences(v[i].Value)
+		}
+	}
+	return v
+}
+
+// resolve works out the value of a reference, resolving whatever it refers
+// to first.
+func (p *parser) resolve(r *reference) (perr *ParseError) {
+	switch r.state {
+	case refResolved, refFailed:
+		// Any problem has already been reported.
+		return nil
+	case refResolving:
+		chain := []string{}
+		for _, ref := range p.resolving[p.indexResolving(r):] {
+			chain = append(chain, ref.key.String())
+		}
+		chain = append(chain, r.key.String())
+		return r.errorf(r.it.pos, "Reference cycle: %s.", strings.Join(chain, " -> "))
+	}
+
+	r.state = refResolving
+	p.resolving = append(p.resolving, r)
+	defer func() {
+		p.resolving = p.resolving[:len(p.resolving)-1]
+		if perr != nil {
+			r.state = refFailed
+		} else {
+			r.state = refResolved
+		}
+	}()
+
+	if r.str != "" {
+		r.val, perr = p.interpolate(r)
+		return perr
+	}
+	val, perr := p.lookup(r, r.name(), r.it.pos)
+	if perr != nil {
+		return perr
+	}
+	if r.val, perr = p.copyValue(val); perr != nil {
+		return perr
+	}
+	if r.hash {
+		p.setTypes(r.key, r.val)
+	}
+	return nil
+}
+
+func (p *parser) indexResolving(r *reference) int {
+	for i, ref := range p.resolving {
+		if ref == r {
+			return i
+		}
+	}
+	return 0
+}
+
+// lookup returns the value of the key with the given name, seen from the
+// reference r, looking in each hash enclosing r in turn. A reference never
+// refers to itself, so `port = $port` gets port from an enclosing hash.
+// Names with a scheme, like `env:HOME`, are given to its Resolver instead.
+func (p *parser) lookup(r *reference, name string, pos Pos) (interface{}, *ParseError) {
+	if scheme, arg, ok := splitScheme(name); ok {
+		return p.resolveScheme(r, scheme, arg, pos)
+	}
+	path := strings.Split(name, ".")
+	for _, hash := range r.scopes {
+		val, ok, perr := p.lookupPath(hash, path)
+		if perr != nil {
+			return nil, perr
+		}
+		if ok && val != r {
+			return val, nil
+		}
+	}
+	return nil, r.errorf(pos, "Undefined variable '%s'.", name)
+}
+
+// lookupPath returns the value at the given path of keys within a hash,
+// resolving any references on the way.
+func (p *parser) lookupPath(hash map[string]interface{}, path []string) (interface{}, bool, *ParseError) {
+	var val interface{} = hash
+	for _, k := range path {
+		h, ok := val.(map[string]interface{})
+		if !ok {
+			return nil, false, nil
+		}
+		if val, ok = h[k]; !ok {
+			return nil, false, nil
+		}
+		if ref, ok := val.(*reference); ok {
+			if ref.state == refResolving {
+				// This is either a cycle, or the reference being looked up
+				// from, which the caller skips.
+				if ref == p.resolving[len(p.resolving)-1] {
+					return ref, true, nil
+				}
+			}
+			if perr := p.resolve(ref); perr != nil {
+				return nil, false, perr
+			}
+			if ref.state != refResolved {
+				return nil, false, nil
+			}
+			val = ref.val
+		}
+	}
+	return val, true, nil
+}
+
+// copyValue returns a copy of a referenced value, so that the referenced
+// hashes and arrays are not shared, with any references in it resolved.
+func (p *parser) copyValue(v interface{}) (interface{}, *ParseError) {
+	switch v := v.(type) {
+	case *reference:
+		if perr := p.resolve(v); perr != nil {
+			return nil, perr
+		}
+		return p.copyValue(v.val)
+	case map[string]interface{}:
+		hash := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			val, perr := p.copyValue(val)
+			if perr != nil {
+				return nil, perr
+			}
+			hash[k] = val
+		}
+		return hash, nil
+	case []interface{}:
+		array := make([]interface{}, len(v))
+		for i, val := range v {
+			val, perr := p.copyValue(val)
+			if perr != nil {
+				return nil, perr
+			}
+			array[i] = val
+		}
+		return array, nil
+	}
+	return v, nil
+}
+
+// setTypes records the types of a referenced value set at key, and of the
+// keys of any hashes within it.
+func (p *parser) setTypes(key Key, v interface{}) {
+	var typ confType
+	switch v := v.(type) {
+	case string:
+		typ = confString
+	case int64:
+		typ = confInteger
+	case float64:
+		typ = confFloat
+	case bool:
+		typ = confBool
+	case time.Time:
+		typ = confDatetime
+	case Date:
+		typ = confDate
+	case TimeOfDay:
+		typ = confTimeOfDay
+	case time.Duration:
+		typ = confDuration
+	case nil:
+		typ = confNull
+	case map[string]interface{}:
+		typ = confHash
+		for k, val := range v {
+			p.setTypes(key.add(k), val)
+		}
+	case []interface{}:
+		typ = typeOfArrayValues(v)
+		for i, val := range v {
+			if _, ok := val.(map[string]interface{}); ok {
+				p.setTypes(key.index(i), val)
+			}
+		}
+	}
+	p.types[key.String()] = typ
+}
+
+// interpolate returns the string of r with each `${name}` in it replaced by
+// the text of the value name refers to. A `${` without a closing '}' is
+// left as written.
+func (p *parser) interpolate(r *reference) (interface{}, *ParseError) {
+	var buf strings.Builder
+	s := r.str
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			buf.WriteString(s)
+			return buf.String(), nil
+		}
+		if i > 0 && s[i-1] == variableStart {
+			// An escaped `$${`.
+			buf.WriteString(s[:i-1] + "${")
+			s = s[i+2:]
+			continue
+		}
+		end := strings.IndexByte(s[i:], mapEnd)
+		if end < 0 {
+			buf.WriteString(s)
+			return buf.String(), nil
+		}
+		buf.WriteString(s[:i])
+		token, name := s[i:i+end+1], s[i+2:i+end]
+		val, perr := p.lookup(r, name, r.posOf(token))
+		if perr != nil {
+			return nil, perr
+		}
+		text, ok := textOf(val)
+		if !ok {
+			return nil, r.errorf(r.posOf(token), "Cannot use the value of '%s' in a string.", name)
+		}
+		buf.WriteString(text)
+		s = s[i+end+1:]
+	}
+}
+
+// posOf returns the position of token within the string of r, or of the
+// string itself if it can't be found.
+func (r *reference) posOf(token string) Pos {
+	i := strings.Index(r.it.val, token)
+	if i < 0 {
+		return r.it.pos
+	}
+	pos := r.it.pos
+	for _, c := range r.it.val[:i] {
+		if c == '\n' {
+			pos.Line++
+			pos.Column = 1
+		} else {
+			pos.Column++
+		}
+	}
+	return pos
+}
+
+// textOf returns the text of a primitive value for use within a string.
+func textOf(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	case time.Time:
+		return v.Format(time.RFC3339Nano), true
+	case Date, TimeOfDay:
+		return v.(fmt.Stringer).String(), true
+	case time.Duration:
+		return formatDuration(v), true
+	}
+	return "", false
+}
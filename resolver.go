@@ -0,0 +1,102 @@
+package confl
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// A Resolver provides values from outside of the data, for references with
+// a scheme such as `${env:HOME}`. Resolve is given the rest of the reference
+// after the scheme and its colon, and the value is always a string.
+//
+// Two schemes are always available, unless DecodeOptions.Safe is set:
+//
+//	password = ${env:DB_PASSWORD}        # an environment variable
+//	user = ${env:DB_USER:-admin}         # with a default if unset or empty
+//	token = ${file:/run/secrets/token}   # a file, without surrounding space
+//
+// Others can be added with DecodeOptions.Resolvers.
+type Resolver interface {
+	Resolve(arg string) (string, error)
+}
+
+// ResolverFunc is an adapter to allow the use of ordinary functions as
+// Resolvers.
+type ResolverFunc func(arg string) (string, error)
+
+// Resolve calls f(arg).
+func (f ResolverFunc) Resolve(arg string) (string, error) {
+	return f(arg)
+}
+
+func resolveEnv(arg string) (string, error) {
+	name := arg
+	if i := strings.Index(arg, ":-"); i >= 0 {
+		if name = arg[:i]; os.Getenv(name) == "" {
+			return arg[i+2:], nil
+		}
+	}
+	val, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable '%s' is not set", name)
+	}
+	return val, nil
+}
+
+func resolveFile(arg string) (string, error) {
+	bs, err := ioutil.ReadFile(arg)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(bs)), nil
+}
+
+// newResolvers returns the resolvers for each scheme allowed by the given
+// options, or nil if none are.
+func newResolvers(opts DecodeOptions) map[string]Resolver {
+	if opts.Safe {
+		return nil
+	}
+	resolvers := map[string]Resolver{
+		"env":  ResolverFunc(resolveEnv),
+		"file": ResolverFunc(resolveFile),
+	}
+	for scheme, r := range opts.Resolvers {
+		resolvers[scheme] = r
+	}
+	return resolvers
+}
+
+// splitScheme splits a reference like `env:HOME` into its scheme and the
+// rest, if it has a scheme.
+func splitScheme(name string) (scheme, arg string, ok bool) {
+	i := strings.IndexByte(name, ':')
+	if i <= 0 {
+		return "", "", false
+	}
+	for _, r := range name[:i] {
+		if !isIdentifierRune(r, "_") {
+			return "", "", false
+		}
+	}
+	return name[:i], name[i+1:], true
+}
+
+// resolveScheme returns the value given by the resolver for the scheme of
+// the reference name, found in r.
+func (p *parser) resolveScheme(r *reference, scheme, arg string, pos Pos) (interface{}, *ParseError) {
+	if p.resolvers == nil {
+		return nil, r.errorf(pos, "Cannot resolve '%s:%s', resolvers are disabled.", scheme, arg)
+	}
+	resolver, ok := p.resolvers[scheme]
+	if !ok {
+		return nil, r.errorf(pos, "Unknown resolver '%s' in '%s:%s'.", scheme, scheme, arg)
+	}
+	val, err := resolver.Resolve(arg)
+	if err != nil {
+		return nil, r.errorf(pos, "Cannot resolve '%s:%s': %s", scheme, arg, err)
+	}
+	return val, nil
+}
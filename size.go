@@ -0,0 +1,105 @@
+package confl
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Integers may have a size suffix, which multiplies them as in gnatsd and
+// libucl. The suffixes are case insensitive:
+//
+//	k, m, g, t           SI, powers of 1000, e.g. 1k = 1000
+//	kb, mb, gb, tb       binary, powers of 1024, e.g. 1kb = 1024
+//	ki, mi, gi, ti       binary, as are the same with a trailing b, e.g. 2GiB
+//
+// except for a lone lowercase `m`, which is a duration in minutes. Use `M`
+// for millions.
+var sizeMultipliers = map[string]int64{
+	"k": 1e3, "m": 1e6, "g": 1e9, "t": 1e12,
+	"kb": 1 << 10, "mb": 1 << 20, "gb": 1 << 30, "tb": 1 << 40,
+	"ki": 1 << 10, "mi": 1 << 20, "gi": 1 << 30, "ti": 1 << 40,
+	"kib": 1 << 10, "mib": 1 << 20, "gib": 1 << 30, "tib": 1 << 40,
+}
+
+// sizeSuffixLen returns the length of the size suffix that s starts with,
+// or 0 if it doesn't start with one.
+func sizeSuffixLen(s string) int {
+	n := 0
+	for n < len(s) && (s[n] >= 'a' && s[n] <= 'z' || s[n] >= 'A' && s[n] <= 'Z') {
+		n++
+	}
+	if _, ok := sizeMultipliers[strings.ToLower(s[:n])]; !ok || s[:n] == "m" {
+		return 0
+	}
+	return n
+}
+
+// splitSizeSuffix splits an integer from its size suffix, returning the
+// multiplier for the suffix, or 1 if it has none. As in the lexer, a lone
+// lowercase `m` isn't a size suffix.
+func splitSizeSuffix(s string) (string, int64) {
+	i := len(s)
+	for i > 0 && (s[i-1] >= 'a' && s[i-1] <= 'z' || s[i-1] >= 'A' && s[i-1] <= 'Z') {
+		i--
+	}
+	if mult, ok := sizeMultipliers[strings.ToLower(s[i:])]; ok && s[i:] != "m" {
+		return s[:i], mult
+	}
+	return s, 1
+}
+
+// ByteSize is a number of bytes, which can be written with a size suffix
+// such as `64MB`. It decodes from integers, with or without a suffix, and
+// from strings holding one, and the Encoder writes it in its most compact
+// form.
+type ByteSize int64
+
+// Units for ByteSize values, in binary multiples.
+const (
+	KB ByteSize = 1 << (10 * (iota + 1))
+	MB
+	GB
+	TB
+)
+
+// sizeUnits are the suffixes that a ByteSize is written with, largest first.
+var sizeUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"TB", 1 << 40}, {"T", 1e12},
+	{"GB", 1 << 30}, {"G", 1e9},
+	{"MB", 1 << 20}, {"M", 1e6},
+	{"KB", 1 << 10}, {"K", 1e3},
+}
+
+// String returns the shortest way to write the size, e.g. `64MB` rather
+// than `67108864`.
+func (b ByteSize) String() string {
+	s := strconv.FormatInt(int64(b), 10)
+	if b == 0 {
+		return s
+	}
+	for _, unit := range sizeUnits {
+		if int64(b)%unit.size != 0 {
+			continue
+		}
+		if short := strconv.FormatInt(int64(b)/unit.size, 10) + unit.suffix; len(short) < len(s) {
+			s = short
+		}
+	}
+	return s
+}
+
+func (b ByteSize) MarshalText() ([]byte, error) {
+	return []byte(b.String()), nil
+}
+
+func (b *ByteSize) UnmarshalText(text []byte) error {
+	n, err := parseInteger(strings.TrimSpace(string(text)))
+	if err != nil {
+		return e("Invalid size '%s': %s", text, err)
+	}
+	*b = ByteSize(n)
+	return nil
+}
@@ -0,0 +1,168 @@
+package confl
+
+import (
+	"fmt"
+	"strings"
+)
+
+// tableHeader starts the table named by a TOML style header, `[db.primary]`,
+// or a new table at the end of the array named by `[[servers]]`. The keys up
+// to the next header are set in the table. Hashes named on the way to it are
+// created as needed, and for an array of tables, its last table is used.
+func (p *parser) tableHeader(it item) *ParseError {
+	p.leaveTables()
+	parts, err := splitTableName(it.val)
+	if err != nil {
+		return p.tableError(it, Key{it.val}, "Invalid table name '%s': %s.", it.val, err)
+	}
+	for _, part := range parts[:len(parts)-1] {
+		p.pushKey(part, it.span())
+		p.currentKey = part
+		ctx := p.ctx.(map[string]interface{})
+		key := p.nextKey()
+		var hash map[string]interface{}
+		switch old := ctx[part].(type) {
+		case map[string]interface{}:
+			hash = old
+		case []interface{}:
+			if !p.tableArrays[key.String()] {
+				return p.tableError(it, parts, "Key '%s' is already defined, and is not a table.", key)
+			}
+			hash = old[len(old)-1].(map[string]interface{})
+			key = key.index(len(old) - 1)
+		default:
+			if _, exists := ctx[part]; exists {
+				return p.tableError(it, parts, "Key '%s' is already defined, and is not a table.", key)
+			}
+			hash = make(map[string]interface{})
+			ctx[part] = hash
+			p.addKey(confHash, it)
+			p.addImplicit(key)
+		}
+		p.popKey()
+		p.enterTable(hash, key)
+	}
+
+	last := parts[len(parts)-1]
+	p.pushKey(last, it.span())
+	p.currentKey = last
+	ctx := p.ctx.(map[string]interface{})
+	key := p.nextKey()
+	old, exists := ctx[last]
+	hash := make(map[string]interface{})
+	if it.typ == itemArrayTable {
+		array, ok := old.([]interface{})
+		switch {
+		case !exists:
+			ctx[last] = []interface{}{hash}
+			p.addKey(confArrayHash, it)
+			p.tableArrays[key.String()] = true
+		case ok && p.tableArrays[key.String()]:
+			ctx[last] = append(array, hash)
+		default:
+			return p.tableError(it, parts, "Key '%s' is already defined, and is not an array of tables.", key)
+		}
+		key = key.index(len(array))
+	} else {
+		switch old := old.(type) {
+		case map[string]interface{}:
+			if !p.isImplicit(key) {
+				return p.tableError(it, parts, "Table '%s' is already defined %s.",
+					key, p.where(p.positions[key.String()]))
+			}
+			// A table made on the way to another one can be defined once.
+			p.removeImplicit(key)
+			p.positions[key.String()] = Position{File: p.file(), Key: it.span(), Value: it.span()}
+			hash = old
+		default:
+			if exists {
+				return p.tableError(it, parts, "Key '%s' is already defined, and is not a table.", key)
+			}
+			ctx[last] = hash
+			p.addKey(confHash, it)
+		}
+	}
+	p.popKey()
+	p.enterTable(hash, key)
+	return nil
+}
+
+// tableError returns an error for a table header that can't be used. Keys up
+// to the next header are set in a table of their own, which is thrown away,
+// so that their errors can still be found.
+func (p *parser) tableError(it item, name Key, format string, v ...interface{}) *ParseError {
+	perr := p.errorf(it.pos, format, v...)
+	p.leaveTables()
+	p.dropKeys()
+	p.enterTable(make(map[string]interface{}), name)
+	return perr
+}
+
+func (p *parser) enterTable(hash map[string]interface{}, key Key) {
+	p.pushContext(hash, key)
+	p.scopes[len(p.scopes)-1].table = true
+}
+
+// leaveTables goes back to the top level from the table of the last header,
+// or for an included file, to where it was included.
+func (p *parser) leaveTables() {
+	floor := p.sources[len(p.sources)-1].scopes
+	for len(p.scopes) > 1 && len(p.scopes) > floor && p.scopes[len(p.scopes)-1].table {
+		p.popContext()
+	}
+}
+
+// splitTableName splits the name of a table header into its keys, which are
+// separated by dots, and may be quoted to hold dots or spaces of their own.
+func splitTableName(name string) ([]string, error) {
+	var parts []string
+	s := name
+	for {
+		s = strings.TrimLeft(s, " \t")
+		var part string
+		switch {
+		case s == "":
+			return nil, fmt.Errorf("expected a key")
+		case s[0] == dqStringStart:
+			i := 1
+			for i < len(s) && s[i] != dqStringEnd {
+				if s[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			if i >= len(s) {
+				return nil, fmt.Errorf("unterminated quoted key")
+			}
+			var err error
+			if part, err = unescape(s[1:i]); err != nil {
+				return nil, err
+			}
+			s = s[i+1:]
+		case s[0] == sqStringStart:
+			i := strings.IndexByte(s[1:], sqStringEnd)
+			if i < 0 {
+				return nil, fmt.Errorf("unterminated quoted key")
+			}
+			part, s = s[1:i+1], s[i+2:]
+		default:
+			i := strings.IndexAny(s, ". \t")
+			if i < 0 {
+				i = len(s)
+			}
+			if i == 0 {
+				return nil, fmt.Errorf("expected a key")
+			}
+			part, s = s[:i], s[i:]
+		}
+		parts = append(parts, part)
+		s = strings.TrimLeft(s, " \t")
+		if s == "" {
+			return parts, nil
+		}
+		if s[0] != '.' {
+			return nil, fmt.Errorf("expected '.' but got '%c'", s[0])
+		}
+		s = s[1:]
+	}
+}
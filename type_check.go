@@ -31,18 +31,23 @@ var (
 	confInteger   confBaseType = "Integer"
 	confFloat     confBaseType = "Float"
 	confDatetime  confBaseType = "Datetime"
+	confDate      confBaseType = "Date"
+	confTimeOfDay confBaseType = "TimeOfDay"
+	confDuration  confBaseType = "Duration"
 	confString    confBaseType = "String"
 	confBool      confBaseType = "Bool"
+	confNull      confBaseType = "Null"
 	confArray     confBaseType = "Array"
 	confHash      confBaseType = "Hash"
 	confArrayHash confBaseType = "ArrayHash"
 )
 
 // typeOfPrimitive returns a confType of any primitive value in conf.
-// Primitive values are: Integer, Float, Datetime, String and Bool.
+// Primitive values are: Integer, Float, Datetime, String, Bool and Null.
 //
 // Passing a lexer item other than the following will cause a BUG message
-// to occur: itemString, itemBool, itemInteger, itemFloat, itemDatetime.
+// to occur: itemString, itemBool, itemInteger, itemFloat, itemDatetime,
+// itemDate, itemTime, itemDuration, itemNull.
 func (p *parser) typeOfPrimitive(lexItem item) confType {
 	switch lexItem.typ {
 	case itemInteger:
@@ -51,10 +56,18 @@ func (p *parser) typeOfPrimitive(lexItem item) confType {
 		return confFloat
 	case itemDatetime:
 		return confDatetime
-	case itemString:
+	case itemDate:
+		return confDate
+	case itemTime:
+		return confTimeOfDay
+	case itemDuration:
+		return confDuration
+	case itemString, itemQuotedString, itemRawString, itemBlockString, itemHeredoc, itemIndentedHeredoc:
 		return confString
 	case itemBool:
 		return confBool
+	case itemNull:
+		return confNull
 	}
 	p.bug("Cannot infer primitive type of lex item '%s'.", lexItem)
 	panic("unreachable")
@@ -80,3 +93,18 @@ func (p *parser) typeOfArray(types []confType) confType {
 	}
 	return confArray
 }
+
+// typeOfArrayValues returns a confType for an array given its parsed values.
+// Non-empty arrays containing only hashes are arrays of hashes, any other
+// array is just an "Array".
+func typeOfArrayValues(values []interface{}) confType {
+	if len(values) == 0 {
+		return confArray
+	}
+	for _, v := range values {
+		if _, ok := v.(map[string]interface{}); !ok {
+			return confArray
+		}
+	}
+	return confArrayHash
+}
@@ -19,6 +19,8 @@ type field struct {
 	tag   bool         // whether field has a `confl` tag
 	index []int        // represents the depth of an anonymous field
 	typ   reflect.Type // the type of the field
+	label bool         // whether the field is set to a label of its block
+	args  bool         // whether the field is set to arguments of its directive
 }
 
 // byName sorts field by name, breaking ties with depth,
@@ -97,6 +99,7 @@ func typeFields(t reflect.Type) []field {
 					continue
 				}
 				name := sf.Tag.Get("confl")
+				label, args := false, false
 				if name == "-" {
 					continue
 				} else if name != "" {
@@ -104,6 +107,8 @@ func typeFields(t reflect.Type) []field {
 					parts := strings.Split(name, ",")
 					if len(parts) > 1 {
 						name = parts[0]
+						label = hasOption(parts[1:], "label")
+						args = hasOption(parts[1:], "args")
 					}
 				}
 				if name == "" {
@@ -134,7 +139,7 @@ func typeFields(t reflect.Type) []field {
 					if name == "" {
 						name = sf.Name
 					}
-					fields = append(fields, field{name, tagged, index, ft})
+					fields = append(fields, field{name, tagged, index, ft, label, args})
 					if count[f.typ] > 1 {
 						// If there were multiple instances, add a second,
 						// so that the annihilation code will see a duplicate.
@@ -258,3 +263,43 @@ func cachedTypeFields(t reflect.Type) []field {
 	fieldCache.Unlock()
 	return f
 }
+
+// hasOption returns true if the options of a struct tag include opt.
+func hasOption(opts []string, opt string) bool {
+	for _, o := range opts {
+		if o == opt {
+			return true
+		}
+	}
+	return false
+}
+
+// labelFields returns the fields of a struct type that are set to the labels
+// of its blocks, in order, or nil if t isn't a struct or has none.
+func labelFields(t reflect.Type) []field {
+	return optionFields(t, func(f field) bool { return f.label })
+}
+
+// argsFields returns the fields of a struct type that are set to the
+// arguments of its directive, in order, or nil if t isn't a struct or has
+// none.
+func argsFields(t reflect.Type) []field {
+	return optionFields(t, func(f field) bool { return f.args })
+}
+
+func optionFields(t reflect.Type, has func(field) bool) []field {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	var fields []field
+	for _, f := range cachedTypeFields(t) {
+		if has(f) {
+			fields = append(fields, f)
+		}
+	}
+	sort.Sort(byIndex(fields))
+	return fields
+}